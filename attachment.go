@@ -0,0 +1,57 @@
+package ordersystem
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Attachment types which can be uploaded. Images are decoded and encoded again, which removes EXIF and other metadata.
+const (
+	AttachmentJPEG = "image/jpeg"
+	AttachmentPNG  = "image/png"
+	AttachmentPDF  = "application/pdf"
+)
+
+// Attachment is a file which has been uploaded along with a message. The file is stored in the attachment directory, in a subdirectory named after the collection. Attachments are deleted when the collection is archived or deleted.
+type Attachment struct {
+	ID      string
+	CollID  string
+	EventID int
+	Name    string // sanitized filename
+	Type    string // sniffed MIME type
+	Size    int
+}
+
+// FmtSize returns the size in KB or MB, like "1,5 MB".
+func (a *Attachment) FmtSize() string {
+	if a.Size < 1<<20 {
+		return fmt.Sprintf("%d KB", (a.Size+1023)>>10)
+	}
+	return strings.Replace(fmt.Sprintf("%.1f MB", float64(a.Size)/(1<<20)), ".", ",", 1)
+}
+
+func (a *Attachment) IsImage() bool {
+	return strings.HasPrefix(a.Type, "image/")
+}
+
+// Link returns an absolute URL without host. Client and store use the same path.
+func (a *Attachment) Link() string {
+	return fmt.Sprintf("/collection/%s/attachment/%s", a.CollID, a.ID)
+}
+
+// AttachmentFile is an attachment which is about to be stored.
+type AttachmentFile struct {
+	Name string
+	Type string
+	Data []byte
+}
+
+// HasAttachments returns whether any event has attachments.
+func (coll *Collection) HasAttachments() bool {
+	for _, event := range coll.Log {
+		if len(event.Attachments) > 0 {
+			return true
+		}
+	}
+	return false
+}
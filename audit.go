@@ -0,0 +1,28 @@
+package ordersystem
+
+import "time"
+
+// Audit actions which are not store routes. Store routes are recorded as method and route pattern, like "GET /collection/:collid".
+const (
+	AuditLogin       = "login"
+	AuditLoginFailed = "login-failed"
+	AuditLogout      = "logout"
+)
+
+// AuditEntry records an action of a store user. The audit log is append-only, entries are removed by the retention only.
+type AuditEntry struct {
+	ID       int
+	Time     time.Time
+	Username string
+	Action   string
+	Target   string // route parameters like the collection ID, and the query string
+}
+
+// AuditFilter selects audit entries. Zero values match all entries.
+type AuditFilter struct {
+	Username string
+	Action   string // substring
+	Target   string // substring
+	From     time.Time
+	To       time.Time // exclusive
+}
@@ -1,80 +1,289 @@
 package ordersystem
 
 import (
+	"cmp"
+	"fmt"
 	"log"
-	"time"
-
-	"github.com/dys2p/eco/delivery"
+	"slices"
 )
 
-// Bot runs some automatic transitions.
+// BotAction is an automatic transition which the bot has planned for a collection.
+type BotAction struct {
+	CollID   string
+	State    CollState
+	Action   string // like in CollFSM
+	Reason   string
+	Eligible Date // the action is executed on the first bot run at or after this date
+}
+
+// Due returns whether the action can be executed today.
+func (action BotAction) Due() bool {
+	return action.Eligible <= Today()
+}
+
+// Bot runs some automatic transitions and returns the planned actions, including those which are not due yet.
+// If dryRun is true, no action is executed.
 // In order to avoid loops, it must be triggered by the ui only.
-func (db *DB) Bot(coll *Collection) error {
+func (db *DB) Bot(coll *Collection, dryRun bool) ([]BotAction, error) {
 	// if actions can be done subsequently, it's useful to put them in that order
-	if err := db.BotArchive(coll); err != nil {
-		return err
+	var steps = []struct {
+		plan    func(*Collection) (*BotAction, error)
+		execute func(*Collection) error
+	}{
+		{db.planArchive, db.BotArchive},
+		{db.planDelete, db.BotDelete},
+		{db.planFinalize, db.BotFinalize},
+		{db.planCancel, db.BotCancel}, // before reminding, so no reminder is sent right before cancellation
+		{db.planRemind, db.BotRemind},
 	}
-	if err := db.BotDelete(coll); err != nil {
-		return err
+	// TODO process unfetched tasks
+
+	var actions []BotAction
+	for _, step := range steps {
+		action, err := step.plan(coll)
+		if err != nil {
+			return actions, err
+		}
+		if action == nil {
+			continue
+		}
+		actions = append(actions, *action)
+		if dryRun || !action.Due() {
+			continue
+		}
+		if err := step.execute(coll); err != nil {
+			return actions, err
+		}
+		if action.Action == "delete" {
+			break
+		}
 	}
-	if err := db.BotFinalize(coll); err != nil {
-		return err
+	return actions, nil
+}
+
+// BotPlan returns the planned actions for all collections without executing them.
+func (db *DB) BotPlan() ([]BotAction, error) {
+	var actions []BotAction
+	for _, from := range CollFSM.From(Bot) {
+		collIDs, err := db.ReadColls(CollState(from))
+		if err != nil {
+			return nil, err
+		}
+		for _, collID := range collIDs {
+			coll, err := db.ReadColl(collID)
+			if err != nil {
+				return nil, err
+			}
+			collActions, err := db.Bot(coll, true)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", collID, err)
+			}
+			actions = append(actions, collActions...)
+		}
 	}
-	// TODO process unfetched tasks
-	return nil
+	slices.SortFunc(actions, func(a, b BotAction) int {
+		if a.Eligible != b.Eligible {
+			return cmp.Compare(a.Eligible, b.Eligible)
+		}
+		return cmp.Compare(a.CollID, b.CollID)
+	})
+	return actions, nil
 }
 
-func (db *DB) BotArchive(coll *Collection) error {
+// planArchive returns an action if the retention policy of the collection state wipes personal data.
+func (db *DB) planArchive(coll *Collection) (*BotAction, error) {
 	if !coll.BotCan("archive") {
-		return nil
+		return nil, nil
+	}
+	var policy = db.Config.Retention[coll.State]
+	if policy.ArchiveDays <= 0 || !coll.Settled() {
+		return nil, nil
+	}
+	var copied = *coll
+	if !copied.Wipe(policy.Wipe) && !coll.HasAttachments() && !CollFSM.Can(Bot, State(coll.State), State(Archived)) {
+		return nil, nil // nothing to do
 	}
-	since, err := coll.LatestEventSince()
+	eligible, err := retentionDate(coll).AddDays(policy.ArchiveDays)
 	if err != nil {
+		return nil, err
+	}
+	return &BotAction{
+		CollID:   coll.ID,
+		State:    coll.State,
+		Action:   "archive",
+		Reason:   fmt.Sprintf("Aufbewahrungsfrist: %d Tage nach dem letzten Ereignis", policy.ArchiveDays),
+		Eligible: eligible,
+	}, nil
+}
+
+// BotArchive wipes personal data according to the retention policy and deletes message attachments. If the FSM allows it, the collection is moved to the Archived state.
+func (db *DB) BotArchive(coll *Collection) error {
+	var newState = coll.State
+	if CollFSM.Can(Bot, State(coll.State), State(Archived)) {
+		newState = Archived
+	}
+	coll.Wipe(db.Config.Retention[coll.State].Wipe)
+	if err := db.UpdateCollAndTasks(coll); err != nil {
 		return err
 	}
-	if since > 2*7*24*time.Hour && coll.Due() == 0 { // more than two weeks and we're even
-		coll.ClientContact = ""
-		coll.ClientContactProtocol = ""
-		coll.DeliveryAddress = delivery.Address{}
-		coll.DeliveryTrackingIDs = nil
-		// keep DeliveryMethod and country
-		if err := db.UpdateCollAndTasks(coll); err != nil {
-			return err
+	if err := db.DeleteAttachments(coll.ID); err != nil {
+		return err
+	}
+	log.Printf("archiving %s (%s)", coll.ID, coll.State)
+	return db.UpdateCollState(Bot, coll, newState, 0, archiveMessage)
+}
+
+// archiveMessage is the text of the event which BotArchive writes.
+const archiveMessage = "Kontakt- und Lieferinformationen wurden gelöscht."
+
+// retentionDate returns the date of the latest event from which the retention periods are counted.
+// The archiving event is not counted, else it would postpone the deletion of cancelled and rejected collections, which keep their state.
+func retentionDate(coll *Collection) Date {
+	var archived = fmt.Sprintf("%s: %s", Bot.Name(), archiveMessage)
+	var date Date
+	for _, event := range coll.Log {
+		if event.Text != archived {
+			date = max(date, event.Date)
 		}
-		log.Printf("archiving %s", coll.ID)
-		return db.UpdateCollState(Bot, coll, Archived, 0, "")
 	}
-	return nil
+	return date
 }
 
-func (db *DB) BotDelete(coll *Collection) error {
+// planDelete returns an action if the retention policy of the collection state deletes it. Collections with booked payments or refunds are kept for accounting.
+func (db *DB) planDelete(coll *Collection) (*BotAction, error) {
 	if !coll.BotCan("delete") {
-		return nil
+		return nil, nil
 	}
-	since, err := coll.LatestEventSince()
-	if err != nil {
-		return err
+	var policy = db.Config.Retention[coll.State]
+	if policy.DeleteDays <= 0 || coll.HasPayments() {
+		return nil, nil
 	}
-	if since > 2*7*24*time.Hour { // more than two weeks
-		log.Printf("deleting %s (%s)", coll.ID, coll.State)
-		return db.Delete(Bot, coll)
+	eligible, err := retentionDate(coll).AddDays(policy.DeleteDays)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return &BotAction{
+		CollID:   coll.ID,
+		State:    coll.State,
+		Action:   "delete",
+		Reason:   fmt.Sprintf("Löschfrist: %d Tage nach dem letzten Ereignis", policy.DeleteDays),
+		Eligible: eligible,
+	}, nil
 }
 
-func (db *DB) BotFinalize(coll *Collection) error {
+func (db *DB) BotDelete(coll *Collection) error {
+	log.Printf("deleting %s (%s)", coll.ID, coll.State)
+	return db.Delete(Bot, coll)
+}
+
+func (db *DB) planFinalize(coll *Collection) (*BotAction, error) {
 	if !coll.BotCan("finalize") {
-		return nil
+		return nil, nil
 	}
 	if coll.Due() > 0 {
-		return nil
+		return nil, nil
 	}
 	for _, task := range coll.Tasks {
 		if task.State != Fetched && task.State != Reshipped {
 			// any task is neither fetched nor reshipped
-			return nil
+			return nil, nil
 		}
 	}
+	return &BotAction{
+		CollID:   coll.ID,
+		State:    coll.State,
+		Action:   "finalize",
+		Reason:   "Bezahlt und alle Aufträge abgeholt oder versendet",
+		Eligible: Today(),
+	}, nil
+}
+
+func (db *DB) BotFinalize(coll *Collection) error {
 	log.Printf("finalizing %s", coll.ID)
 	return db.UpdateCollState(Bot, coll, Finalized, 0, "Bestellauftrag ist abgeschlossen")
 }
+
+// planRemind returns the next payment reminder for accepted collections which have not been paid in full and have no open invoice.
+func (db *DB) planRemind(coll *Collection) (*BotAction, error) {
+	if !coll.BotCan("remind") {
+		return nil, nil
+	}
+	if coll.Due() <= 0 {
+		return nil, nil
+	}
+	if open, err := db.HasOpenInvoices(coll.ID); err != nil || open {
+		return nil, err // the client is paying
+	}
+	var accepted = coll.StateSince()
+	var sent = coll.PaymentRemindersSince(accepted)
+	if sent >= len(db.Config.PaymentReminderDays) {
+		return nil, nil
+	}
+	eligible, err := accepted.AddDays(db.Config.PaymentReminderDays[sent])
+	if err != nil {
+		return nil, err
+	}
+	return &BotAction{
+		CollID:   coll.ID,
+		State:    coll.State,
+		Action:   "remind",
+		Reason:   fmt.Sprintf("Zahlungserinnerung %d: %d Tage nach Annahme, %s offen", sent+1, db.Config.PaymentReminderDays[sent], FmtEuro(coll.Due())),
+		Eligible: eligible,
+	}, nil
+}
+
+// BotRemind sends a payment reminder. At most one reminder is sent per run, even if several are overdue.
+func (db *DB) BotRemind(coll *Collection) error {
+	var message = fmt.Sprintf("Erinnerung: Dein Bestellauftrag wurde angenommen, aber wir haben noch nicht den vollen Betrag erhalten. Bitte lasse uns %s zukommen.", FmtEuro(coll.Due()))
+	if db.Config.CancelUnpaidDays > 0 && coll.Paid() == 0 {
+		cancel, err := coll.StateSince().AddDays(db.Config.CancelUnpaidDays)
+		if err != nil {
+			return err
+		}
+		cancelStr, err := cancel.Format()
+		if err != nil {
+			return err
+		}
+		message = fmt.Sprintf("%s Andernfalls wird der Bestellauftrag am %s abgebrochen.", message, cancelStr)
+	}
+
+	coll.PaymentReminders = append(coll.PaymentReminders, Today())
+	if err := db.UpdateCollAndTasks(coll); err != nil {
+		return err
+	}
+	log.Printf("sending payment reminder for %s", coll.ID)
+	return db.CreateEvent(Bot, coll, 0, message)
+}
+
+// planCancel returns an action for accepted collections which have not been paid at all and have no open invoice.
+// If a part has been paid, the store staff must decide.
+func (db *DB) planCancel(coll *Collection) (*BotAction, error) {
+	if !coll.BotCan("cancel") {
+		return nil, nil
+	}
+	if db.Config.CancelUnpaidDays <= 0 {
+		return nil, nil
+	}
+	if coll.Paid() != 0 {
+		return nil, nil
+	}
+	if open, err := db.HasOpenInvoices(coll.ID); err != nil || open {
+		return nil, err // a payment might be confirmed later, and a cancelled collection can't take it
+	}
+	eligible, err := coll.StateSince().AddDays(db.Config.CancelUnpaidDays)
+	if err != nil {
+		return nil, err
+	}
+	return &BotAction{
+		CollID:   coll.ID,
+		State:    coll.State,
+		Action:   "cancel",
+		Reason:   fmt.Sprintf("Keine Zahlung innerhalb von %d Tagen nach Annahme", db.Config.CancelUnpaidDays),
+		Eligible: eligible,
+	}, nil
+}
+
+func (db *DB) BotCancel(coll *Collection) error {
+	log.Printf("cancelling unpaid %s", coll.ID)
+	return db.UpdateCollState(Bot, coll, Cancelled, 0, fmt.Sprintf("Der Bestellauftrag wurde abgebrochen, weil innerhalb von %d Tagen keine Zahlung eingegangen ist. Falls du bereits bezahlt hast, melde dich bitte bei uns.", db.Config.CancelUnpaidDays))
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dys2p/ordersystem"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	attachmentMaxFiles  = 5
+	attachmentMaxSize   = 10 << 20 // per file
+	attachmentMaxPixels = 40_000_000
+	messageMaxBody      = attachmentMaxFiles*attachmentMaxSize + 1<<20
+)
+
+// limitBody rejects request bodies which are larger than limit. It must wrap the client or store middleware, because they parse the form when they verify the CSRF token.
+func limitBody(limit int64, errorPage func(http.ResponseWriter, *http.Request, string), f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			errorPage(w, r, fmt.Sprintf("Die Anhänge sind zu groß. Du kannst höchstens %d Dateien mit je %d MB anhängen.", attachmentMaxFiles, attachmentMaxSize>>20))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		f(w, r)
+	}
+}
+
+// readAttachments checks the uploaded files of the "attachments" form field and removes metadata from images. Errors are meant for the user.
+func readAttachments(r *http.Request) ([]*ordersystem.AttachmentFile, error) {
+	if r.MultipartForm == nil {
+		return nil, nil // no multipart form, no files
+	}
+	var headers = r.MultipartForm.File["attachments"]
+	if len(headers) > attachmentMaxFiles {
+		return nil, fmt.Errorf("Du kannst höchstens %d Dateien anhängen.", attachmentMaxFiles)
+	}
+	var files []*ordersystem.AttachmentFile
+	for _, header := range headers {
+		var name = attachmentName(header.Filename)
+		if header.Size > attachmentMaxSize {
+			return nil, fmt.Errorf("Die Datei %s ist größer als %d MB.", name, attachmentMaxSize>>20)
+		}
+		f, err := header.Open()
+		if err != nil {
+			return nil, fmt.Errorf("Die Datei %s konnte nicht gelesen werden.", name)
+		}
+		data, err := io.ReadAll(io.LimitReader(f, attachmentMaxSize+1))
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Die Datei %s konnte nicht gelesen werden.", name)
+		}
+		if len(data) == 0 {
+			continue
+		}
+		if len(data) > attachmentMaxSize {
+			return nil, fmt.Errorf("Die Datei %s ist größer als %d MB.", name, attachmentMaxSize>>20)
+		}
+		var file = &ordersystem.AttachmentFile{
+			Name: name,
+			Type: http.DetectContentType(data), // don't trust the type given by the browser
+		}
+		switch file.Type {
+		case ordersystem.AttachmentJPEG, ordersystem.AttachmentPNG:
+			file.Data, err = stripImage(data, file.Type)
+			if err != nil {
+				return nil, fmt.Errorf("Das Bild %s konnte nicht verarbeitet werden.", name)
+			}
+		case ordersystem.AttachmentPDF:
+			file.Data = data
+		default:
+			return nil, fmt.Errorf("Die Datei %s hat einen nicht erlaubten Typ. Erlaubt sind JPEG, PNG und PDF.", name)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// attachmentName returns the base name of an uploaded file without control characters, shortened to 100 characters.
+func attachmentName(filename string) string {
+	filename = strings.ReplaceAll(filename, `\`, "/") // some browsers send Windows paths
+	if i := strings.LastIndex(filename, "/"); i >= 0 {
+		filename = filename[i+1:]
+	}
+	filename = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, filename))
+	if runes := []rune(filename); len(runes) > 100 {
+		filename = string(runes[:100])
+	}
+	if filename == "" || filename == "." || filename == ".." {
+		filename = "anhang"
+	}
+	return filename
+}
+
+// stripImage decodes and encodes the image, which drops EXIF and other metadata. The EXIF orientation of JPEG images is applied before, because it gets lost too.
+func stripImage(data []byte, mimeType string) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > attachmentMaxPixels {
+		return nil, errors.New("image too large")
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	switch mimeType {
+	case ordersystem.AttachmentJPEG:
+		err = jpeg.Encode(&buf, orient(img, jpegOrientation(data)), &jpeg.Options{Quality: 90})
+	case ordersystem.AttachmentPNG:
+		err = png.Encode(&buf, img)
+	default:
+		err = fmt.Errorf("unsupported image type: %s", mimeType)
+	}
+	return buf.Bytes(), err
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG image, or 1 if it is missing or can't be parsed.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		var marker = data[pos+1]
+		if marker == 0xDA || marker == 0xD9 { // start of scan, end of image
+			return 1
+		}
+		var length = int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return 1
+		}
+		var segment = data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of the TIFF structure in an EXIF segment.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	var ifd = int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	var entries = int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		var entry = ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orient flips and rotates the image according to the EXIF orientation.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	var b = img.Bounds()
+	var w, h = b.Dx(), b.Dy()
+	var dst *image.RGBA
+	if orientation >= 5 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w)) // width and height are swapped
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, w, h))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // flip horizontal
+				dx, dy = w-1-x, y
+			case 3: // rotate 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // flip vertical
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 90° counterclockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// serveAttachment serves an attachment of the collection. Authorization happens in the client or store middleware.
+func (srv *Server) serveAttachment(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	attachment, err := srv.DB.ReadAttachment(coll.ID, httprouter.ParamsFromContext(r.Context()).ByName("attachmentid"))
+	if errors.Is(err, ordersystem.ErrNotFound) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	f, err := srv.DB.OpenAttachment(attachment)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var disposition = "attachment"
+	if attachment.IsImage() {
+		disposition = "inline"
+	}
+	w.Header().Set("Cache-Control", "private")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name}))
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("Content-Type", attachment.Type)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, f)
+	return nil
+}
+
+func (srv *Server) clientCollAttachmentGet(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	return srv.serveAttachment(w, r, coll)
+}
+
+func (srv *Server) storeCollAttachmentGet(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	return srv.serveAttachment(w, r, coll)
+}
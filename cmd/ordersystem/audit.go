@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dys2p/ordersystem"
+	"github.com/dys2p/ordersystem/html"
+	"github.com/julienschmidt/httprouter"
+)
+
+const auditLimit = 500
+
+// auditRoute returns the method and route pattern of a store request, and the route parameters and query string as target.
+// httprouter v1.3.0 doesn't save the matched route, so the parameter values are replaced in the path.
+func auditRoute(r *http.Request) (string, string) {
+	var path = r.URL.Path
+	var target []string
+	for _, param := range httprouter.ParamsFromContext(r.Context()) {
+		path = strings.Replace(path, "/"+param.Value, "/:"+param.Key, 1)
+		target = append(target, param.Value)
+	}
+	if r.URL.RawQuery != "" {
+		target = append(target, "?"+r.URL.RawQuery)
+	}
+	return r.Method + " " + path, strings.Join(target, " ")
+}
+
+func (srv *Server) audit(username, action, target string) error {
+	return srv.DB.CreateAuditEntry(&ordersystem.AuditEntry{
+		Time:     time.Now(),
+		Username: username,
+		Action:   action,
+		Target:   target,
+	})
+}
+
+// pruneAudit deletes audit entries which are older than the retention.
+func (srv *Server) pruneAudit() error {
+	if srv.DB.Config.AuditRetentionDays == 0 {
+		return nil
+	}
+	return srv.DB.DeleteAuditEntries(time.Now().AddDate(0, 0, -srv.DB.Config.AuditRetentionDays))
+}
+
+type storeAudit struct {
+	html.TemplateData
+	Entries []*ordersystem.AuditEntry
+	Filter  url.Values
+	Limit   int
+}
+
+// storeAuditGet lists the newest audit entries which match the filter in the query string.
+func (srv *Server) storeAuditGet(w http.ResponseWriter, r *http.Request) error {
+	var query = r.URL.Query()
+	var filter = ordersystem.AuditFilter{
+		Username: strings.TrimSpace(query.Get("username")),
+		Action:   strings.TrimSpace(query.Get("action")),
+		Target:   strings.TrimSpace(query.Get("target")),
+	}
+	if from, err := time.ParseInLocation(time.DateOnly, query.Get("from"), time.Local); err == nil {
+		filter.From = from
+	}
+	if to, err := time.ParseInLocation(time.DateOnly, query.Get("to"), time.Local); err == nil {
+		filter.To = to.AddDate(0, 0, 1) // including the given day
+	}
+	entries, err := srv.DB.ReadAuditEntries(filter, auditLimit)
+	if err != nil {
+		return err
+	}
+	return html.StoreAudit.Execute(w, storeAudit{
+		TemplateData: srv.storeTemplateData(r),
+		Entries:      entries,
+		Filter:       query,
+		Limit:        auditLimit,
+	})
+}
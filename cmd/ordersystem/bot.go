@@ -1,36 +1,267 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"text/tabwriter"
+	"time"
 
+	"github.com/dys2p/btcpay"
 	"github.com/dys2p/ordersystem"
+	"github.com/dys2p/ordersystem/html"
 )
 
-// collection ids to be processed by the bot
-var botCollIDs = make(chan string, 100)
-
-func (srv *Server) BotColl(id string) {
+// BotColl runs the bot on a single collection.
+func (srv *Server) BotColl(id string) error {
 	coll, err := srv.DB.ReadColl(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil // deleted in the meantime
+	}
 	if err != nil {
-		log.Printf("bot: error reading %s: %v", id, err)
+		return fmt.Errorf("reading %s: %w", id, err)
 	}
-	if err := srv.DB.Bot(coll); err != nil {
-		log.Printf("bot: error: %s: %v", coll.ID, err)
+	if _, err := srv.DB.Bot(coll, false); err != nil {
+		return fmt.Errorf("%s: %w", coll.ID, err)
 	}
+	return nil
 }
 
-func (srv *Server) Bot() {
-	fmt.Println("running bot")
+// BotStates runs the bot on all collections in the given states. Errors are collected, so one collection can't block the others.
+func (srv *Server) BotStates(states ...ordersystem.CollState) error {
+	var errs []error
+	for _, state := range states {
+		collIDs, err := srv.DB.ReadColls(state)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("reading %s collections: %w", state, err))
+			continue
+		}
+		for _, collID := range collIDs {
+			if err := srv.BotColl(collID); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (srv *Server) Bot() error {
+	log.Println("running bot")
+	var errs []error
+	if err := srv.BotReconcile(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := srv.BotRefunds(); err != nil {
+		errs = append(errs, err)
+	}
 	// get pre-transition states where actor is Bot, so we don't have to try each state
+	var states []ordersystem.CollState
 	for _, from := range ordersystem.CollFSM.From(ordersystem.Bot) {
-		collIDs, err := srv.DB.ReadColls(ordersystem.CollState(from))
+		states = append(states, ordersystem.CollState(from))
+	}
+	if err := srv.BotStates(states...); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// BotReconcile books settled invoices whose "invoice settled" webhook has been missed, e.g. because the ordersystem was down.
+// The payments of expired or invalid invoices are added to the review queue in case the "invoice expired" webhook has been missed too.
+func (srv *Server) BotReconcile() error {
+	invoices, err := srv.DB.ReadOpenInvoices()
+	if err != nil {
+		return fmt.Errorf("reading open invoices: %w", err)
+	}
+	var errs []error
+	for _, invoice := range invoices {
+		if err := srv.reconcileInvoice(invoice); err != nil {
+			errs = append(errs, fmt.Errorf("reconciling invoice %s: %w", invoice.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (srv *Server) reconcileInvoice(invoice *ordersystem.Invoice) error {
+
+	// the BTCPay API tells us the invoice status and the end of monitoring
+
+	status, err := srv.BtcPayStore.GetInvoice(invoice.ID)
+	if err != nil {
+		return err
+	}
+
+	var expired bool
+	switch status.Status {
+	case btcpay.InvoiceSettled:
+		// book it below
+	case btcpay.InvoiceExpired, btcpay.InvoiceInvalid:
+		if time.Now().Unix() <= status.MonitoringExpiration {
+			return nil // payments can still be detected
+		}
+		expired = true
+	default:
+		return nil // still waiting
+	}
+
+	srv.paymentMutex.Lock()
+	defer srv.paymentMutex.Unlock()
+
+	coll, err := srv.DB.ReadColl(invoice.CollID)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("bot: closing invoice %s, collection %s has been deleted", invoice.ID, invoice.CollID)
+		return srv.DB.UpdateInvoiceStatus(invoice, ordersystem.InvoiceClosed)
+	}
+	if err != nil {
+		return err
+	}
+
+	booked, err := srv.DB.InvoiceBooked(coll, invoice.ID)
+	if err != nil {
+		return err
+	}
+	if booked {
+		return srv.DB.UpdateInvoiceStatus(invoice, ordersystem.InvoiceBooked) // booked before the invoice table recorded it
+	}
+
+	if expired {
+		bitpayInvoice, err := srv.BitpayClient.GetInvoice(invoice.ID)
 		if err != nil {
-			log.Printf("bot: error reading %s collections: %v", from, err)
+			return err
+		}
+		if err := srv.invoiceExpiredPartially(coll, bitpayInvoice); err != nil {
+			return err
+		}
+		return srv.DB.UpdateInvoiceStatus(invoice, ordersystem.InvoiceClosed) // no more payments will be detected
+	}
+
+	if !coll.BotCan("confirm-payment") {
+		log.Printf("bot: closing settled invoice %s, collection %s is %s and can't take a payment", invoice.ID, coll.ID, coll.State)
+		return srv.DB.UpdateInvoiceStatus(invoice, ordersystem.InvoiceClosed)
+	}
+
+	// like the webhook, get the payments and rates via the bitpay API
+	bitpayInvoice, err := srv.BitpayClient.GetInvoice(invoice.ID)
+	if err != nil {
+		return err
+	}
+	log.Printf("bot: booking settled invoice %s of collection %s", invoice.ID, coll.ID)
+	return srv.invoiceSettled(coll, bitpayInvoice) // marks the invoice as booked
+}
+
+// BotRefunds books completed refund payouts as negative payments.
+func (srv *Server) BotRefunds() error {
+	refunds, err := srv.DB.ReadPendingRefunds()
+	if err != nil {
+		return fmt.Errorf("reading pending refunds: %w", err)
+	}
+	var errs []error
+	for _, refund := range refunds {
+		if err := srv.bookRefund(refund); err != nil {
+			errs = append(errs, fmt.Errorf("booking refund %s: %w", refund.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (srv *Server) bookRefund(refund *ordersystem.Refund) error {
+	payouts, err := srv.PullPayments.GetPayouts(refund.ID)
+	if err != nil {
+		return err
+	}
+
+	var completed = 0
+	for _, payout := range payouts {
+		if payout.State != PayoutCompleted {
 			continue
 		}
-		for _, collID := range collIDs {
-			srv.BotColl(collID)
+		cents, err := payout.Cents()
+		if err != nil {
+			return err
+		}
+		completed += cents
+	}
+	completed = min(completed, refund.Cents)
+
+	// the client can claim the pull payment in several payouts, so it is done when the full amount has been paid out or no more claims are possible
+	var done = completed == refund.Cents
+	if !done {
+		pullPayment, err := srv.PullPayments.GetPullPayment(refund.ID)
+		if err != nil {
+			return err
+		}
+		done = pullPayment.Archived
+	}
+
+	var cents = completed - refund.BookedCents
+	if cents <= 0 && !done {
+		return nil // nothing new has been paid out
+	}
+
+	srv.paymentMutex.Lock()
+	defer srv.paymentMutex.Unlock()
+
+	coll, err := srv.DB.ReadColl(refund.CollID)
+	if err != nil {
+		return err
+	}
+
+	var message string
+	switch {
+	case completed == refund.Cents:
+		message = fmt.Sprintf("Rückerstattung wurde ausgezahlt: %s.", html.FmtEuro(cents))
+	case done:
+		message = fmt.Sprintf("Rückerstattung wurde beendet. Insgesamt ausgezahlt: %s von %s.", html.FmtEuro(completed), html.FmtEuro(refund.Cents))
+	default:
+		message = fmt.Sprintf("Rückerstattung wurde teilweise ausgezahlt: %s. Insgesamt ausgezahlt: %s von %s.", html.FmtEuro(cents), html.FmtEuro(completed), html.FmtEuro(refund.Cents))
+	}
+	log.Printf("bot: booking %d cents of refund %s of collection %s, completed: %t", cents, refund.ID, coll.ID, done)
+	return srv.DB.BookRefund(refund, coll, max(cents, 0), done, message)
+}
+
+// runBotCommand runs the bot once on all collections, without payment reconciliation and refunds. With -dry-run, it only prints the planned actions.
+func runBotCommand(db *ordersystem.DB, args []string) error {
+	var flags = flag.NewFlagSet("bot", flag.ExitOnError)
+	var dryRun = flags.Bool("dry-run", false, "list planned actions without executing them")
+	flags.Parse(args)
+
+	var actions []ordersystem.BotAction
+	if *dryRun {
+		var err error
+		actions, err = db.BotPlan()
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, from := range ordersystem.CollFSM.From(ordersystem.Bot) {
+			collIDs, err := db.ReadColls(ordersystem.CollState(from))
+			if err != nil {
+				return err
+			}
+			for _, collID := range collIDs {
+				coll, err := db.ReadColl(collID)
+				if err != nil {
+					return err
+				}
+				collActions, err := db.Bot(coll, false)
+				if err != nil {
+					log.Printf("bot: error: %s: %v", coll.ID, err)
+				}
+				for _, action := range collActions {
+					if action.Due() {
+						actions = append(actions, action) // executed
+					}
+				}
+			}
 		}
 	}
+
+	var out = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "eligible\tdue\tcollection\tstate\taction\treason")
+	for _, action := range actions {
+		fmt.Fprintf(out, "%s\t%t\t%s\t%s\t%s\t%s\n", action.Eligible, action.Due(), action.CollID, action.State, action.Action, action.Reason)
+	}
+	return out.Flush()
 }
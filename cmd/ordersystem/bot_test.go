@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitpay/bitpay-go/key_utils"
+	"github.com/dys2p/bitpay"
+	"github.com/dys2p/btcpay"
+	"github.com/dys2p/ordersystem"
+)
+
+// newReconcileServer returns a server with a temporary database, a dummy BTCPay store and a bitpay API stand-in which serves the invoices of the dummy store with a single payment of 0.001 BTC at 20000 EUR/BTC.
+func newReconcileServer(t *testing.T) (*Server, *sql.DB, *btcpay.DummyStore) {
+	var dir = t.TempDir()
+	sqlDB, err := sql.Open("sqlite3", filepath.Join(dir, "ordersystem.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	db, err := ordersystem.NewDB(sqlDB, ordersystem.DefaultConfig(), filepath.Join(dir, "attachments"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var store = btcpay.NewDummyStore()
+	var api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var id = strings.TrimPrefix(r.URL.Path, "/invoices/")
+		inv, err := store.GetInvoice(id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]bitpay.Invoice{"data": {
+			ID:             inv.ID,
+			OrderID:        inv.OrderID,
+			ExpirationTime: inv.ExpirationTime * 1000,
+			CryptoInfo: []bitpay.CryptoInfo{{
+				CryptoCode: "BTC",
+				Rate:       20000,
+				Payments: []bitpay.Payment{{
+					ID:           inv.ID + "-payment",
+					ReceivedDate: time.Unix(inv.CreatedTime, 0).UTC().Format("2006-01-02T15:04:05.999"),
+					Value:        0.001,
+				}},
+			}},
+		}})
+	}))
+	t.Cleanup(api.Close)
+
+	var srv = &Server{
+		BitpayClient: &bitpay.Client{API: api.URL, Key: key_utils.GeneratePem()},
+		BtcPayStore:  store,
+		DB:           db,
+		jobWake:      make(chan struct{}, 1),
+	}
+	return srv, sqlDB, store
+}
+
+// createInvoice creates a collection in the given state and an invoice with the given status for it. Expired and invalid invoices are not monitored any more.
+func createInvoice(t *testing.T, srv *Server, sqlDB *sql.DB, store *btcpay.DummyStore, collID string, state ordersystem.CollState, status string) string {
+	if err := srv.DB.CreateCollection(&ordersystem.Collection{ID: collID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlDB.Exec("update coll set state = ? where id = ?", state, collID); err != nil {
+		t.Fatal(err)
+	}
+	inv, err := store.CreateInvoice(&btcpay.InvoiceRequest{
+		Amount:          20,
+		Currency:        "EUR",
+		InvoiceMetadata: btcpay.InvoiceMetadata{OrderID: collID},
+		InvoiceCheckout: btcpay.InvoiceCheckout{ExpirationMinutes: 60, MonitoringMinutes: 1440},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv.Status = status
+	if status == btcpay.InvoiceExpired || status == btcpay.InvoiceInvalid {
+		inv.MonitoringExpiration = time.Now().Unix() - 1
+	}
+	if err := srv.DB.CreateInvoice(inv.ID, collID); err != nil {
+		t.Fatal(err)
+	}
+	return inv.ID
+}
+
+func TestReconcileBooksOnce(t *testing.T) {
+	srv, sqlDB, store := newReconcileServer(t)
+	var invoiceID = createInvoice(t, srv, sqlDB, store, "AAAAAA", ordersystem.Accepted, btcpay.InvoiceSettled)
+
+	stale, err := srv.DB.ReadColl("AAAAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the webhook books the invoice
+	if err := srv.processInvoiceEvent(&btcpay.InvoiceEvent{Type: btcpay.EventInvoiceSettled, InvoiceID: invoiceID}); err != nil {
+		t.Fatal(err)
+	}
+
+	// another writer saves the collection data which it has read before, and the webhook is redelivered
+	if err := srv.DB.UpdateCollAndTasks(stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.processInvoiceEvent(&btcpay.InvoiceEvent{Type: btcpay.EventInvoiceSettled, InvoiceID: invoiceID}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the reconciler has read the invoice while it was still open
+	if err := srv.reconcileInvoice(&ordersystem.Invoice{ID: invoiceID, CollID: "AAAAAA", Status: ordersystem.InvoiceOpen}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.BotReconcile(); err != nil {
+		t.Fatal(err)
+	}
+
+	coll, err := srv.DB.ReadColl("AAAAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coll.State != ordersystem.Active {
+		t.Errorf("got state %s, want %s", coll.State, ordersystem.Active)
+	}
+	if paid := coll.Paid(); paid != 2000 {
+		t.Errorf("got paid %d, want 2000", paid)
+	}
+	open, err := srv.DB.ReadOpenInvoices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(open) != 0 {
+		t.Errorf("got %d open invoices, want 0", len(open))
+	}
+}
+
+func TestReconcileClosesUnbookable(t *testing.T) {
+	srv, sqlDB, store := newReconcileServer(t)
+	createInvoice(t, srv, sqlDB, store, "AAAAAA", ordersystem.Cancelled, btcpay.InvoiceSettled)
+	createInvoice(t, srv, sqlDB, store, "BBBBBB", ordersystem.Accepted, btcpay.InvoiceSettled)
+	if _, err := sqlDB.Exec("delete from coll where id = 'BBBBBB'"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := srv.BotReconcile(); err != nil {
+			t.Fatalf("sweep %d: %v", i, err)
+		}
+	}
+
+	open, err := srv.DB.ReadOpenInvoices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(open) != 0 {
+		t.Errorf("got %d open invoices, want 0", len(open))
+	}
+	coll, err := srv.DB.ReadColl("AAAAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coll.State != ordersystem.Cancelled || coll.Paid() != 0 {
+		t.Errorf("got state %s and paid %d, want cancelled collection without payment", coll.State, coll.Paid())
+	}
+}
+
+func TestReconcileReviewsExpired(t *testing.T) {
+	srv, sqlDB, store := newReconcileServer(t)
+	createInvoice(t, srv, sqlDB, store, "AAAAAA", ordersystem.Accepted, btcpay.InvoiceExpired)
+	var handled = createInvoice(t, srv, sqlDB, store, "BBBBBB", ordersystem.Accepted, btcpay.InvoiceInvalid)
+
+	// the webhook of the second invoice has been processed
+	if err := srv.processInvoiceEvent(&btcpay.InvoiceEvent{Type: btcpay.EventInvoiceExpired, InvoiceID: handled, PartiallyPaid: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := srv.BotReconcile(); err != nil {
+			t.Fatalf("sweep %d: %v", i, err)
+		}
+	}
+
+	open, err := srv.DB.ReadOpenInvoices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(open) != 0 {
+		t.Errorf("got %d open invoices, want 0", len(open))
+	}
+	reviews, err := srv.DB.ReadPaymentReviews(ordersystem.ReviewOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reviews) != 2 {
+		t.Errorf("got %d payment reviews, want 2", len(reviews))
+	}
+	for _, collID := range []string{"AAAAAA", "BBBBBB"} {
+		coll, err := srv.DB.ReadColl(collID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var messages = 0
+		for _, event := range coll.Log {
+			if strings.Contains(event.Text, "abgelaufen") {
+				messages++
+			}
+		}
+		if messages != 1 || coll.Paid() != 0 {
+			t.Errorf("%s: got %d messages and paid %d, want one message and no payment", collID, messages, coll.Paid())
+		}
+	}
+}
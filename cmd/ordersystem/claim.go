@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/dys2p/ordersystem"
+)
+
+// storeCollClaimPost assigns the collection to the store user. Taking over a collection which someone else has claimed requires the "takeover" field.
+func (srv *Server) storeCollClaimPost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	var username = srv.sessionUsername(r)
+	if coll.Assignee != "" && coll.Assignee != username && r.PostFormValue("takeover") == "" {
+		srv.notify(r.Context(), "Der Auftrag %s wurde inzwischen von %s übernommen.", coll.ID, coll.Assignee)
+		http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
+		return nil
+	}
+	if err := srv.DB.UpdateCollAssignee(coll, username); err != nil {
+		return err
+	}
+	srv.notify(r.Context(), "Du hast den Auftrag %s übernommen.", coll.ID)
+	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
+	return nil
+}
+
+// storeCollReleasePost removes the assignee. Only the assignee and admins can release a collection.
+func (srv *Server) storeCollReleasePost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	if coll.Assignee != srv.sessionUsername(r) && srv.sessionRole(r) != ordersystem.RoleAdmin {
+		return ErrNotFound
+	}
+	if err := srv.DB.UpdateCollAssignee(coll, ""); err != nil {
+		return err
+	}
+	srv.notify(r.Context(), "Der Auftrag %s wurde freigegeben.", coll.ID)
+	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dys2p/ordersystem"
+	"github.com/julienschmidt/httprouter"
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    *atomLink   `xml:"link,omitempty"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// atomTime converts a Date to the RFC 3339 format which Atom requires.
+func atomTime(date ordersystem.Date) string {
+	t, err := date.Parse()
+	if err != nil {
+		return time.Time{}.Format(time.RFC3339)
+	}
+	return t.Format(time.RFC3339)
+}
+
+// feedLink returns the absolute feed URL if the client URL is configured, else the path.
+func (srv *Server) feedLink(token string) string {
+	if token == "" {
+		return ""
+	}
+	return srv.DB.Config.ClientURL + "/feed/" + token
+}
+
+// clientFeedGet publishes the event log of a collection as an Atom feed. The token is the only authentication.
+func (srv *Server) clientFeedGet(w http.ResponseWriter, r *http.Request) error {
+	coll, err := srv.DB.ReadFeedColl(httprouter.ParamsFromContext(r.Context()).ByName("token"))
+	if err != nil {
+		return err
+	}
+
+	var feed = atomFeed{
+		ID:      "urn:ordersystem:collection:" + coll.ID,
+		Title:   "Bestellauftrag " + coll.ID,
+		Updated: atomTime(ordersystem.Today()),
+	}
+	if srv.DB.Config.ClientURL != "" {
+		feed.Link = &atomLink{Href: srv.DB.Config.ClientURL + coll.Link()}
+	}
+	if len(coll.Log) > 0 {
+		feed.Updated = atomTime(coll.Log[0].Date) // newest first
+	}
+	for i, event := range coll.Log {
+		var content strings.Builder
+		content.WriteString(string(event.TextHTML()))
+		if event.Paid != 0 {
+			content.WriteString("<p>Zahlung: " + template.HTMLEscapeString(ordersystem.FmtEuro(event.Paid)) + "</p>")
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      fmt.Sprintf("urn:ordersystem:collection:%s:event:%d", coll.ID, len(coll.Log)-i), // the log is append-only
+			Title:   event.NewState.Name(),
+			Updated: atomTime(event.Date),
+			Content: atomContent{Type: "html", Body: content.String()},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(xml.Header))
+	return xml.NewEncoder(w).Encode(feed)
+}
+
+func (srv *Server) clientCollFeedPost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	switch r.PostFormValue("action") {
+	case "create":
+		if _, err := srv.DB.CreateFeedToken(coll.ID); err != nil {
+			return err
+		}
+		srv.notify(r.Context(), "Ein neuer Feed-Link wurde erzeugt. Ein alter Link funktioniert nicht mehr.")
+	case "revoke":
+		if err := srv.DB.DeleteFeedToken(coll.ID); err != nil {
+			return err
+		}
+		srv.notify(r.Context(), "Der Feed-Link wurde widerrufen.")
+	default:
+		return ErrNotFound
+	}
+	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dys2p/ordersystem"
+)
+
+// EnqueueBot schedules a bot run on the collection. It does not block.
+func (srv *Server) EnqueueBot(collID string) {
+	if err := srv.DB.CreateJob(ordersystem.JobColl, collID, time.Now()); err != nil {
+		log.Printf("error scheduling bot run on %s: %v", collID, err)
+		return
+	}
+	srv.wakeJobs()
+}
+
+func (srv *Server) wakeJobs() {
+	select {
+	case srv.jobWake <- struct{}{}:
+	default: // worker has been woken already
+	}
+}
+
+// RunJobs runs due jobs until ctx is cancelled. A running job is finished before RunJobs returns.
+func (srv *Server) RunJobs(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := srv.DB.ReadNextJob(time.Now())
+		if err == nil {
+			err = srv.runJob(job)
+		}
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, ordersystem.ErrNotFound):
+			// wait below
+		default:
+			log.Printf("jobs: %v", err) // database error, wait before trying again
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-srv.jobWake:
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+// runJob runs the job and records the result. It returns an error only if the result can't be recorded.
+func (srv *Server) runJob(job *ordersystem.Job) error {
+	var jobErr error
+	switch job.Kind {
+	case ordersystem.JobColl:
+		jobErr = srv.BotColl(job.CollID)
+	case ordersystem.JobNotify:
+		jobErr = srv.SendNotifications(job.CollID)
+	case ordersystem.JobReminders:
+		jobErr = srv.BotStates(ordersystem.Accepted)
+	case ordersystem.JobStaff:
+		jobErr = errors.Join(srv.StaffDigests(), srv.deleteIdleSessions(), srv.DB.PruneLoginAttempts(time.Now()))
+	case ordersystem.JobSweep:
+		jobErr = errors.Join(srv.Bot(), srv.pruneAudit(), srv.pruneWebhooks(), srv.enqueuePendingNotifications())
+	default:
+		jobErr = fmt.Errorf("unknown job kind: %s", job.Kind)
+	}
+
+	if jobErr != nil {
+		log.Printf("jobs: %s %s failed (attempt %d): %v", job.Kind, job.CollID, job.Attempts+1, jobErr)
+		if err := srv.DB.FailJob(job, time.Now(), jobErr); err != nil {
+			return fmt.Errorf("recording failure of job %d: %w", job.ID, err)
+		}
+		return nil
+	}
+	if err := srv.DB.FinishJob(job, time.Now()); err != nil {
+		return fmt.Errorf("finishing job %d: %w", job.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dys2p/eco/captcha"
+	"github.com/dys2p/ordersystem"
+)
+
+// loginSource returns the address of the client. If the reverse proxy passes it in a header, the last address in that header is used.
+// Else, and behind Tor, all clients share the address of the proxy, so the source counter is a global limit which never locks, but requires a captcha from everyone.
+func (srv *Server) loginSource(r *http.Request) string {
+	if header := srv.DB.Config.ProxyHeader; header != "" {
+		if values := r.Header.Values(header); len(values) > 0 {
+			var addrs = strings.Split(values[len(values)-1], ",")
+			if addr := strings.TrimSpace(addrs[len(addrs)-1]); addr != "" {
+				return addr
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type loginGuard struct {
+	Keys         []string // key of the ID or username, and source key
+	LockedUntil  time.Time
+	NeedsCaptcha bool
+}
+
+// guardLogin reads the attempt counters of the key and of the request source.
+func (srv *Server) guardLogin(r *http.Request, key string) (*loginGuard, error) {
+	var now = time.Now()
+	var guard = &loginGuard{
+		Keys: []string{key, ordersystem.SourceLoginKey(srv.loginSource(r))},
+	}
+	for _, key := range guard.Keys {
+		a, err := srv.DB.ReadLoginAttempt(key)
+		if err != nil {
+			return nil, err
+		}
+		if a.Locked(now) && a.LockedUntil.After(guard.LockedUntil) {
+			guard.LockedUntil = a.LockedUntil
+		}
+		if a.NeedsCaptcha(now) {
+			guard.NeedsCaptcha = true
+		}
+	}
+	return guard, nil
+}
+
+func (guard *loginGuard) locked() bool {
+	return !guard.LockedUntil.IsZero()
+}
+
+// verifyCaptcha returns true if no captcha is required or if the answer is correct.
+func (guard *loginGuard) verifyCaptcha(r *http.Request) bool {
+	if !guard.NeedsCaptcha {
+		return true
+	}
+	return captcha.Verify(r.PostFormValue("captcha-id"), r.PostFormValue("captcha-answer"))
+}
+
+// loginFailed records the failure. If it requires a captcha from now on, a new captcha is returned.
+func (srv *Server) loginFailed(guard *loginGuard) (captcha.TemplateData, error) {
+	var now = time.Now()
+	if err := srv.DB.LoginFailed(now, guard.Keys...); err != nil {
+		return captcha.TemplateData{}, err
+	}
+	for _, key := range guard.Keys {
+		a, err := srv.DB.ReadLoginAttempt(key)
+		if err != nil {
+			return captcha.TemplateData{}, err
+		}
+		if a.NeedsCaptcha(now) {
+			return captcha.TemplateData{ID: captcha.New()}, nil
+		}
+	}
+	return captcha.TemplateData{}, nil
+}
+
+// loginSucceeded resets the counter of the ID or username. The source counter is not reset, because one valid login should not allow guessing other IDs without captcha.
+func (srv *Server) loginSucceeded(guard *loginGuard) error {
+	return srv.DB.DeleteLoginAttempt(guard.Keys[0])
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"math"
@@ -14,10 +17,10 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
@@ -26,6 +29,7 @@ import (
 	"github.com/dys2p/digitalgoods/userdb"
 	"github.com/dys2p/eco/captcha"
 	"github.com/dys2p/eco/diceware"
+	"github.com/dys2p/eco/email"
 	"github.com/dys2p/eco/httputil"
 	"github.com/dys2p/eco/id"
 	"github.com/dys2p/eco/lang"
@@ -59,6 +63,31 @@ func main() {
 		return
 	}
 
+	// config
+
+	config, err := ordersystem.LoadConfig(filepath.Join(os.Getenv("CONFIGURATION_DIRECTORY"), "config.json"))
+	if err != nil {
+		log.Printf("error loading config: %v", err)
+		return
+	}
+
+	// db
+
+	db, err := ordersystem.NewDB(sqlDB, config, filepath.Join(os.Getenv("STATE_DIRECTORY"), "attachments"))
+	if err != nil {
+		log.Printf("error creating database: %v", err)
+		return
+	}
+
+	// subcommands
+
+	if flag.Arg(0) == "bot" {
+		if err := runBotCommand(db, flag.Args()[1:]); err != nil {
+			log.Printf("error running bot: %v", err)
+		}
+		return
+	}
+
 	// captcha
 
 	captcha.Initialize(filepath.Join(os.Getenv("STATE_DIRECTORY"), "captcha.sqlite3"))
@@ -86,34 +115,67 @@ func main() {
 	// btcpay
 
 	var btcpayStore btcpay.Store
+	var pullPayments PullPayments
 	if *test {
 		btcpayStore = btcpay.NewDummyStore()
+		pullPayments = NewDummyPullPayments()
 		log.Println("\033[33m" + "warning: using btcpay dummy store" + "\033[0m")
 	} else {
-		btcpayStore, err = btcpay.Load(filepath.Join(os.Getenv("CONFIGURATION_DIRECTORY"), "btcpay.json"))
+		serverStore, err := btcpay.Load(filepath.Join(os.Getenv("CONFIGURATION_DIRECTORY"), "btcpay.json"))
 		if err != nil {
 			log.Printf("error loading btcpay store: %v", err)
 			return
 		}
+		btcpayStore = serverStore
+		pullPayments = ServerPullPayments{serverStore}
 
 		log.Println("don't forget to set up the webhook for your store: /rpc")
 		log.Println(`  Event: "A new payment has been received"`)
 		log.Println(`  Event: "An invoice has been settled"`)
+		log.Println(`  Event: "An invoice has expired"`)
 	}
 
-	// session db
+	// notifiers
 
-	sessions, err := initSessionManager()
-	if err != nil {
-		log.Printf("error initializing session manager: %v", err)
-		return
+	var notifiers = make(map[string]Notifier)
+	if *test {
+		notifiers["email"] = email.DummyMailer{}
+		log.Println("\033[33m" + "warning: using dummy mailer" + "\033[0m")
+	} else if smtpPath := filepath.Join(os.Getenv("CONFIGURATION_DIRECTORY"), "smtp.json"); fileExists(smtpPath) {
+		mailer, err := email.LoadSMTP(smtpPath)
+		if err != nil {
+			log.Printf("error loading smtp config: %v", err)
+			return
+		}
+		notifiers["email"] = mailer
+	}
+	if xmppPath := filepath.Join(os.Getenv("CONFIGURATION_DIRECTORY"), "xmpp.json"); fileExists(xmppPath) {
+		x, err := LoadXMPP(xmppPath)
+		if err != nil {
+			log.Printf("error loading xmpp config: %v", err)
+			return
+		}
+		notifiers["xmpp-otr"] = x
+	}
+	if matrixPath := filepath.Join(os.Getenv("CONFIGURATION_DIRECTORY"), "matrix.json"); fileExists(matrixPath) {
+		m, err := LoadMatrix(matrixPath)
+		if err != nil {
+			log.Printf("error loading matrix config: %v", err)
+			return
+		}
+		notifiers["matrix"] = m
+	}
+	for _, protocol := range ordersystem.NotificationProtocols {
+		if _, ok := notifiers[protocol]; !ok {
+			log.Printf("notifications via %s are disabled", protocol)
+		}
 	}
 
-	// db
+	// session db
 
-	db, err := ordersystem.NewDB(sqlDB)
+	sessions, err := initSessionManager()
 	if err != nil {
-		log.Printf("error creating database: %v", err)
+		log.Printf("error initializing session manager: %v", err)
 		return
 	}
 
@@ -123,9 +185,12 @@ func main() {
 		BitpayClient: bitpayClient,
 		BtcPayStore:  btcpayStore,
 		DB:           db,
+		Notifiers:    notifiers,
 		Langs:        langs,
+		PullPayments: pullPayments,
 		Sessions:     sessions,
 		Users:        users,
+		jobWake:      make(chan struct{}, 1),
 	}
 
 	// static sites
@@ -148,40 +213,36 @@ func main() {
 
 	// bot
 
-	var ticker = time.NewTicker(12 * time.Hour)
-	var wg sync.WaitGroup
+	for _, kind := range []ordersystem.JobKind{ordersystem.JobSweep, ordersystem.JobReminders, ordersystem.JobStaff} {
+		if err := db.CreateJob(kind, "", time.Now()); err != nil { // run now
+			log.Printf("error scheduling %s job: %v", kind, err)
+			return
+		}
+	}
 
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	var jobsDone = make(chan struct{})
 	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				wg.Add(1)
-				srv.Bot()
-				wg.Done()
-			case id := <-botCollIDs:
-				wg.Add(1)
-				srv.BotColl(id)
-				wg.Done()
-			}
-		}
+		srv.RunJobs(jobsCtx)
+		close(jobsDone)
 	}()
 
-	srv.Bot() // run now
-
 	// http handlers
 
 	var stop = make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
 	var clientRouter = httprouter.New()
-	clientRouter.ServeFiles("/static/*filepath", http.FS(httputil.ModTimeFS{staticFiles, time.Now()}))
+	clientRouter.ServeFiles("/static/*filepath", http.FS(httputil.ModTimeFS{FS: staticFiles, ModTime: time.Now()}))
 	clientRouter.HandlerFunc(http.MethodGet, "/", srv.client(srv.clientHelloGet))
 	clientRouter.HandlerFunc(http.MethodGet, "/create", srv.client(srv.clientCreateGet))
 	clientRouter.HandlerFunc(http.MethodPost, "/create", srv.client(srv.clientCreatePost))
 	clientRouter.HandlerFunc(http.MethodGet, "/current", srv.client(srv.clientCollCurrentGet))
 	clientRouter.HandlerFunc(http.MethodGet, "/collection", srv.client(srv.clientCollLoginGet))
 	clientRouter.HandlerFunc(http.MethodPost, "/collection", srv.client(srv.clientCollLoginPost))
+	clientRouter.HandlerFunc(http.MethodGet, "/collections", srv.client(srv.clientCollsGet))
 	clientRouter.HandlerFunc(http.MethodGet, "/collection/:collid", srv.clientWithCollection(srv.clientCollViewGet))
+	clientRouter.HandlerFunc(http.MethodGet, "/collection/:collid/attachment/:attachmentid", srv.clientWithCollection(srv.clientCollAttachmentGet))
 	clientRouter.HandlerFunc(http.MethodGet, "/collection/:collid/cancel", srv.clientWithCollection(srv.clientCollCancelGet))
 	clientRouter.HandlerFunc(http.MethodPost, "/collection/:collid/cancel", srv.clientWithCollection(srv.clientCollCancelPost))
 	clientRouter.HandlerFunc(http.MethodGet, "/collection/:collid/delete", srv.clientWithCollection(srv.clientCollDeleteGet))
@@ -189,12 +250,22 @@ func main() {
 	clientRouter.HandlerFunc(http.MethodGet, "/collection/:collid/edit", srv.clientWithCollection(srv.clientCollEditGet))
 	clientRouter.HandlerFunc(http.MethodPost, "/collection/:collid/edit", srv.clientWithCollection(srv.clientCollEditPost))
 	clientRouter.HandlerFunc(http.MethodGet, "/collection/:collid/message", srv.clientWithCollection(srv.clientCollMessageGet))
-	clientRouter.HandlerFunc(http.MethodPost, "/collection/:collid/message", srv.clientWithCollection(srv.clientCollMessagePost))
+	clientRouter.HandlerFunc(http.MethodPost, "/collection/:collid/message", limitBody(messageMaxBody, srv.clientError, srv.clientWithCollection(srv.clientCollMessagePost)))
+	clientRouter.HandlerFunc(http.MethodPost, "/collection/:collid/feed", srv.clientWithCollection(srv.clientCollFeedPost))
+	clientRouter.HandlerFunc(http.MethodPost, "/collection/:collid/logout", srv.clientWithCollection(srv.clientCollLogoutPost))
+	clientRouter.HandlerFunc(http.MethodPost, "/collection/:collid/logout-others", srv.clientWithCollection(srv.clientCollLogoutOthersPost))
+	clientRouter.HandlerFunc(http.MethodPost, "/collection/:collid/notifications", srv.clientWithCollection(srv.clientCollNotificationsPost))
+	clientRouter.HandlerFunc(http.MethodGet, "/collection/:collid/passphrase", srv.clientWithCollection(srv.clientCollPassphraseGet))
+	clientRouter.HandlerFunc(http.MethodPost, "/collection/:collid/passphrase", srv.clientWithCollection(srv.clientCollPassphrasePost))
 	clientRouter.HandlerFunc(http.MethodGet, "/collection/:collid/pay-btcpay", srv.clientWithCollection(srv.clientCollPayBTCPayGet))
 	clientRouter.HandlerFunc(http.MethodPost, "/collection/:collid/pay-btcpay", srv.clientWithCollection(srv.clientCollPayBTCPayPost))
+	clientRouter.HandlerFunc(http.MethodPost, "/collection/:collid/price-change", srv.clientWithCollection(srv.clientCollPriceChangePost))
 	clientRouter.HandlerFunc(http.MethodGet, "/collection/:collid/submit", srv.clientWithCollection(srv.clientCollSubmitGet))
 	clientRouter.HandlerFunc(http.MethodPost, "/collection/:collid/submit", srv.clientWithCollection(srv.clientCollSubmitPost))
 
+	clientRouter.HandlerFunc(http.MethodGet, "/reset", srv.client(srv.clientResetGet))
+	clientRouter.HandlerFunc(http.MethodPost, "/reset", srv.client(srv.clientResetPost))
+	clientRouter.HandlerFunc(http.MethodGet, "/feed/:token", srv.client(srv.clientFeedGet))
 	clientRouter.HandlerFunc(http.MethodPost, "/rpc", srv.rpc)
 	clientRouter.HandlerFunc(http.MethodGet, "/state", srv.client(srv.clientStateGet))
 	clientRouter.HandlerFunc(http.MethodPost, "/state", srv.client(srv.clientStatePost))
@@ -207,48 +278,77 @@ func main() {
 	defer shutdownClientSrv()
 
 	var storeRouter = httprouter.New()
-	storeRouter.ServeFiles("/static/*filepath", http.FS(httputil.ModTimeFS{staticFiles, time.Now()}))
-	storeRouter.HandlerFunc(http.MethodGet, "/login", store(srv.storeLoginGet))
-	storeRouter.HandlerFunc(http.MethodPost, "/login", store(srv.storeLoginPost))
+	storeRouter.ServeFiles("/static/*filepath", http.FS(httputil.ModTimeFS{FS: staticFiles, ModTime: time.Now()}))
+	storeRouter.HandlerFunc(http.MethodGet, "/login", srv.store(srv.storeLoginGet))
+	storeRouter.HandlerFunc(http.MethodPost, "/login", srv.store(srv.storeLoginPost))
+	storeRouter.Handler("GET", "/captcha/:fn", captcha.Handler())
+	storeRouter.HandlerFunc(http.MethodGet, "/login/totp", srv.store(srv.storeLoginTOTPGet))
+	storeRouter.HandlerFunc(http.MethodPost, "/login/totp", srv.store(srv.storeLoginTOTPPost))
 	// with authentication:
-	storeRouter.HandlerFunc(http.MethodGet, "/", srv.auth(store(srv.storeIndexGet)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid", srv.auth(srv.storeWithCollection(srv.storeCollViewGet)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/accept", srv.auth(srv.storeWithCollection(srv.storeCollAcceptGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/accept", srv.auth(srv.storeWithCollection(srv.storeCollAcceptPost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/activate", srv.auth(srv.storeWithCollection(srv.storeCollActivateGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/activate", srv.auth(srv.storeWithCollection(srv.storeCollActivatePost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/confirm-payment", srv.auth(srv.storeWithCollection(srv.storeCollConfirmPaymentGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/confirm-payment", srv.auth(srv.storeWithCollection(srv.storeCollConfirmPaymentPost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/confirm-pickup", srv.auth(srv.storeWithCollection(srv.storeCollConfirmPickupGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/confirm-pickup", srv.auth(srv.storeWithCollection(srv.storeCollConfirmPickupPost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/confirm-pickup/:taskid", srv.auth(srv.storeWithTask(srv.storeTaskConfirmPickupGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/confirm-pickup/:taskid", srv.auth(srv.storeWithTask(srv.storeTaskConfirmPickupPost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/confirm-reshipped", srv.auth(srv.storeWithCollection(srv.storeCollConfirmReshippedGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/confirm-reshipped", srv.auth(srv.storeWithCollection(srv.storeCollConfirmReshippedPost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/confirm-reshipped/:taskid", srv.auth(srv.storeWithTask(srv.storeTaskConfirmReshippedGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/confirm-reshipped/:taskid", srv.auth(srv.storeWithTask(srv.storeTaskConfirmReshippedPost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/delete", srv.auth(srv.storeWithCollection(srv.storeCollDeleteGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/delete", srv.auth(srv.storeWithCollection(srv.storeCollDeletePost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/edit", srv.auth(srv.storeWithCollection(srv.storeCollEditGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/edit", srv.auth(srv.storeWithCollection(srv.storeCollEditPost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/mark-spam", srv.auth(srv.storeWithCollection(srv.storeCollMarkSpamGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/mark-spam", srv.auth(srv.storeWithCollection(srv.storeCollMarkSpamPost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/message", srv.auth(srv.storeWithCollection(srv.storeCollMessageGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/message", srv.auth(srv.storeWithCollection(srv.storeCollMessagePost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/return", srv.auth(srv.storeWithCollection(srv.storeCollReturnGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/return", srv.auth(srv.storeWithCollection(srv.storeCollReturnPost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/reject", srv.auth(srv.storeWithCollection(srv.storeCollRejectGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/reject", srv.auth(srv.storeWithCollection(srv.storeCollRejectPost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/submit", srv.auth(srv.storeWithCollection(srv.storeCollSubmitGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/submit", srv.auth(srv.storeWithCollection(srv.storeCollSubmitPost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/confirm-arrived/:taskid", srv.auth(srv.storeWithTask(srv.storeTaskConfirmArrivedGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/confirm-arrived/:taskid", srv.auth(srv.storeWithTask(srv.storeTaskConfirmArrivedPost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/confirm-ordered/:taskid", srv.auth(srv.storeWithTask(srv.storeTaskConfirmOrderedGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/confirm-ordered/:taskid", srv.auth(srv.storeWithTask(srv.storeTaskConfirmOrderedPost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/mark-failed/:taskid", srv.auth(srv.storeWithTask(srv.storeTaskMarkFailedGet)))
-	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/mark-failed/:taskid", srv.auth(srv.storeWithTask(srv.storeTaskMarkFailedPost)))
-	storeRouter.HandlerFunc(http.MethodGet, "/export", srv.auth(store(srv.storeExport)))
-	storeRouter.HandlerFunc(http.MethodPost, "/logout", store(srv.storeLogoutPost))
+	storeRouter.HandlerFunc(http.MethodGet, "/", srv.auth(ordersystem.PermView, srv.store(srv.storeIndexGet)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid", srv.auth(ordersystem.PermView, srv.storeWithCollection(srv.storeCollViewGet)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/accept", srv.auth("accept", srv.storeWithCollection(srv.storeCollAcceptGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/accept", srv.auth("accept", srv.storeWithCollection(srv.storeCollAcceptPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/activate", srv.auth("activate", srv.storeWithCollection(srv.storeCollActivateGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/activate", srv.auth("activate", srv.storeWithCollection(srv.storeCollActivatePost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/attachment/:attachmentid", srv.auth(ordersystem.PermView, srv.storeWithCollection(srv.storeCollAttachmentGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/claim", srv.auth(ordersystem.PermClaim, srv.storeWithCollection(srv.storeCollClaimPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/confirm-payment", srv.auth("confirm-payment", srv.storeWithCollection(srv.storeCollConfirmPaymentGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/confirm-payment", srv.auth("confirm-payment", srv.storeWithCollection(srv.storeCollConfirmPaymentPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/confirm-pickup", srv.auth("confirm-pickup", srv.storeWithCollection(srv.storeCollConfirmPickupGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/confirm-pickup", srv.auth("confirm-pickup", srv.storeWithCollection(srv.storeCollConfirmPickupPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/confirm-pickup/:taskid", srv.auth("confirm-pickup", srv.storeWithTask(srv.storeTaskConfirmPickupGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/confirm-pickup/:taskid", srv.auth("confirm-pickup", srv.storeWithTask(srv.storeTaskConfirmPickupPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/confirm-reshipped", srv.auth("confirm-reshipped", srv.storeWithCollection(srv.storeCollConfirmReshippedGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/confirm-reshipped", srv.auth("confirm-reshipped", srv.storeWithCollection(srv.storeCollConfirmReshippedPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/confirm-reshipped/:taskid", srv.auth("confirm-reshipped", srv.storeWithTask(srv.storeTaskConfirmReshippedGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/confirm-reshipped/:taskid", srv.auth("confirm-reshipped", srv.storeWithTask(srv.storeTaskConfirmReshippedPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/delete", srv.auth("delete", srv.storeWithCollection(srv.storeCollDeleteGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/delete", srv.auth("delete", srv.storeWithCollection(srv.storeCollDeletePost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/edit", srv.auth("edit", srv.storeWithCollection(srv.storeCollEditGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/edit", srv.auth("edit", srv.storeWithCollection(srv.storeCollEditPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/mark-spam", srv.auth("mark-spam", srv.storeWithCollection(srv.storeCollMarkSpamGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/mark-spam", srv.auth("mark-spam", srv.storeWithCollection(srv.storeCollMarkSpamPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/message", srv.auth("message", srv.storeWithCollection(srv.storeCollMessageGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/message", limitBody(messageMaxBody, srv.storeError, srv.auth("message", srv.storeWithCollection(srv.storeCollMessagePost))))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/refund", srv.auth("refund", srv.storeWithCollection(srv.storeCollRefundGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/refund", srv.auth("refund", srv.storeWithCollection(srv.storeCollRefundPost)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/release", srv.auth(ordersystem.PermClaim, srv.storeWithCollection(srv.storeCollReleasePost)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/reset-code", srv.auth(ordersystem.PermResetCode, srv.storeWithCollection(srv.storeCollResetCodePost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/return", srv.auth("return", srv.storeWithCollection(srv.storeCollReturnGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/return", srv.auth("return", srv.storeWithCollection(srv.storeCollReturnPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/reject", srv.auth("reject", srv.storeWithCollection(srv.storeCollRejectGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/reject", srv.auth("reject", srv.storeWithCollection(srv.storeCollRejectPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/submit", srv.auth("submit", srv.storeWithCollection(srv.storeCollSubmitGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/submit", srv.auth("submit", srv.storeWithCollection(srv.storeCollSubmitPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/confirm-arrived/:taskid", srv.auth("confirm-arrived", srv.storeWithTask(srv.storeTaskConfirmArrivedGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/confirm-arrived/:taskid", srv.auth("confirm-arrived", srv.storeWithTask(srv.storeTaskConfirmArrivedPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/confirm-ordered/:taskid", srv.auth("confirm-ordered", srv.storeWithTask(srv.storeTaskConfirmOrderedGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/confirm-ordered/:taskid", srv.auth("confirm-ordered", srv.storeWithTask(srv.storeTaskConfirmOrderedPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/collection/:collid/mark-failed/:taskid", srv.auth("mark-failed", srv.storeWithTask(srv.storeTaskMarkFailedGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/collection/:collid/mark-failed/:taskid", srv.auth("mark-failed", srv.storeWithTask(srv.storeTaskMarkFailedPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/audit", srv.auth(ordersystem.PermAudit, srv.store(srv.storeAuditGet)))
+	storeRouter.HandlerFunc(http.MethodGet, "/export", srv.auth(ordersystem.PermExport, srv.store(srv.storeExport)))
+	storeRouter.HandlerFunc(http.MethodGet, "/reviews", srv.auth(ordersystem.PermView, srv.store(srv.storeReviewsGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/reviews/:id", srv.auth(ordersystem.PermReviews, srv.store(srv.storeReviewPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/inbox", srv.auth(ordersystem.PermView, srv.store(srv.storeInboxGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/inbox/read", srv.auth(ordersystem.PermView, srv.store(srv.storeInboxReadPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/settings", srv.auth(ordersystem.PermView, srv.store(srv.storeSettingsGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/settings", srv.auth(ordersystem.PermView, srv.store(srv.storeSettingsPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/totp", srv.auth(ordersystem.PermView, srv.store(srv.storeTOTPGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/totp/confirm", srv.auth(ordersystem.PermView, srv.store(srv.storeTOTPConfirmPost)))
+	storeRouter.HandlerFunc(http.MethodPost, "/totp/disable", srv.auth(ordersystem.PermView, srv.store(srv.storeTOTPDisablePost)))
+	storeRouter.HandlerFunc(http.MethodPost, "/totp/enrol", srv.auth(ordersystem.PermView, srv.store(srv.storeTOTPEnrolPost)))
+	storeRouter.HandlerFunc(http.MethodPost, "/totp/recovery", srv.auth(ordersystem.PermView, srv.store(srv.storeTOTPRecoveryPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/sessions", srv.auth(ordersystem.PermSessions, srv.store(srv.storeSessionsGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/sessions/revoke", srv.auth(ordersystem.PermSessions, srv.store(srv.storeSessionsRevokePost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/locks", srv.auth(ordersystem.PermView, srv.store(srv.storeLocksGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/locks/unlock", srv.auth(ordersystem.PermUnlock, srv.store(srv.storeLocksUnlockPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/bot-report", srv.auth(ordersystem.PermView, srv.store(srv.storeBotReportGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/jobs/:id/retry", srv.auth(ordersystem.PermJobs, srv.store(srv.storeJobRetryPost)))
+	storeRouter.HandlerFunc(http.MethodGet, "/webhooks", srv.auth(ordersystem.PermView, srv.store(srv.storeWebhooksGet)))
+	storeRouter.HandlerFunc(http.MethodPost, "/webhooks/:id/replay", srv.auth(ordersystem.PermWebhooks, srv.store(srv.storeWebhookReplayPost)))
+	storeRouter.HandlerFunc(http.MethodPost, "/logout", srv.store(srv.storeLogoutPost))
 	storeRouter.ServeFiles("/scripts/*filepath", http.FS(scripts.Files))
 
 	shutdownStoreSrv := httputil.ListenAndServe("127.0.0.1:9001", srv.Sessions.LoadAndSave(storeRouter), stop)
@@ -257,7 +357,8 @@ func main() {
 	log.Printf("listening to 127.0.0.1:9000 and 127.0.0.1:9001")
 	<-stop // blocks
 	log.Println("shutting down")
-	wg.Wait()
+	stopJobs()
+	<-jobsDone // waits for the running job only
 }
 
 type collView struct {
@@ -267,6 +368,27 @@ type collView struct {
 	ReadOnly      bool
 	ShowHints     bool
 	Notifications []string
+	Refunds       []*ordersystem.Refund
+	Role          ordersystem.Role            // store only
+	SendLog       []*ordersystem.Notification // store only
+	Username      string                      // store only
+	FeedLink      string                      // client only
+	OtherSessions int                         // client only
+}
+
+// ClaimedByOther returns whether another store user has claimed the collection.
+func (cv collView) ClaimedByOther() bool {
+	return cv.Assignee != "" && cv.Assignee != cv.Username
+}
+
+// StoreCan shadows Collection.StoreCan and additionally checks the role of the store user, so the template shows permitted buttons only.
+func (cv collView) StoreCan(action string) bool {
+	return cv.Role.Can(action) && cv.Collection.StoreCan(action)
+}
+
+// StoreCanTask shadows Collection.StoreCanTask, see StoreCan.
+func (cv collView) StoreCanTask(action string, task *ordersystem.Task) bool {
+	return cv.Role.Can(action) && cv.Collection.StoreCanTask(action, task)
 }
 
 func (cv collView) TaskViews() []html.TaskView {
@@ -306,6 +428,7 @@ type clientCreate struct {
 	Captcha             captcha.TemplateData
 	CheckWrittenDown    bool
 	CheckWrittenDownErr bool
+	Reorder             *ordersystem.Collection // optional, tasks are copied from it
 }
 
 func isID(s string) bool {
@@ -333,7 +456,36 @@ func (data *clientCreate) Valid() bool {
 	return !data.CollIDErr && !data.CollPassErr && !data.Captcha.Err && !data.CheckWrittenDownErr
 }
 
+// reorderSource returns the collection whose tasks shall be copied into the new one, or nil if collID is empty.
+// The client must be logged in to it.
+func (srv *Server) reorderSource(r *http.Request, collID string) (*ordersystem.Collection, error) {
+	if collID == "" {
+		return nil, nil
+	}
+	if !slices.Contains(srv.sessionCollIDs(r.Context()), collID) {
+		return nil, ErrNotFound
+	}
+	coll, err := srv.DB.ReadColl(collID)
+	if err != nil {
+		return nil, err
+	}
+	if valid, err := srv.sessionValid(r.Context(), ordersystem.ClientSession, coll.ID); err != nil {
+		return nil, err
+	} else if !valid {
+		srv.removeColl(r.Context(), coll.ID) // revoked
+		return nil, ErrNotFound
+	}
+	if !coll.CanReorder() {
+		return nil, ErrNotFound
+	}
+	return coll, nil
+}
+
 func (srv *Server) clientCreateGet(w http.ResponseWriter, r *http.Request) error {
+	reorder, err := srv.reorderSource(r, r.URL.Query().Get("reorder"))
+	if err != nil {
+		return err
+	}
 	collPass, err := diceware.Length(5, diceware.German)
 	if err != nil {
 		return err
@@ -345,16 +497,23 @@ func (srv *Server) clientCreateGet(w http.ResponseWriter, r *http.Request) error
 		Captcha: captcha.TemplateData{
 			ID: captcha.New(),
 		},
+		Reorder: reorder,
 	})
 }
 
 func (srv *Server) clientCreatePost(w http.ResponseWriter, r *http.Request) error {
 
+	reorder, err := srv.reorderSource(r, r.PostFormValue("reorder"))
+	if err != nil {
+		return err
+	}
+
 	var data = &clientCreate{
 		TemplateData:     srv.MakeTemplateData(r),
 		CollID:           strings.TrimSpace(r.PostFormValue("collection-id")),
 		CollPass:         strings.TrimSpace(r.PostFormValue("collection-passphrase")),
 		CheckWrittenDown: r.PostFormValue("check-written-down") != "",
+		Reorder:          reorder,
 	}
 
 	if !captcha.Verify(r.PostFormValue("captcha-id"), r.PostFormValue("captcha-answer")) {
@@ -377,11 +536,17 @@ func (srv *Server) clientCreatePost(w http.ResponseWriter, r *http.Request) erro
 		return err
 	}
 
+	if reorder != nil {
+		coll.Tasks = reorder.ReorderTasks()
+	}
+
 	if err := srv.DB.CreateCollection(coll); err != nil {
 		return err
 	}
 
-	srv.loginClient(r.Context(), coll.ID)
+	if err := srv.loginClient(r.Context(), coll.ID); err != nil {
+		return err
+	}
 	http.Redirect(w, r, fmt.Sprintf("/collection/%s/edit", coll.ID), http.StatusSeeOther)
 	return nil
 }
@@ -416,6 +581,7 @@ func (srv *Server) clientCollEditPost(w http.ResponseWriter, r *http.Request, co
 		ShippingTown              string               `json:"shipping-town"`
 		Tasks                     ordersystem.TaskList `json:"tasks"`
 		DeliveryMethod            string               `json:"delivery-method"`
+		MaxTotal                  int                  `json:"max-total"`
 	}
 	if err := json.Unmarshal([]byte(r.PostFormValue("data")), &data); err != nil {
 		return fmt.Errorf("unmarshaling user input: %w", err)
@@ -446,6 +612,7 @@ func (srv *Server) clientCollEditPost(w http.ResponseWriter, r *http.Request, co
 	untrustedInput.DeliveryAddress.Postcode = data.ShippingPostcode
 	untrustedInput.DeliveryAddress.City = data.ShippingTown
 	untrustedInput.Tasks = data.Tasks
+	untrustedInput.MaxTotal = data.MaxTotal
 	if err := coll.Merge(ordersystem.Client, &untrustedInput); err != nil {
 		return err
 	}
@@ -461,6 +628,8 @@ type clientLogin struct {
 	CollID      string
 	CollIDErr   bool
 	CollPassErr bool
+	Captcha     captcha.TemplateData // if required after failed attempts
+	LockedUntil string
 }
 
 // success and error url for payment providers, so we don't reveal the collection ID to them
@@ -473,6 +642,47 @@ func (srv *Server) clientCollCurrentGet(w http.ResponseWriter, r *http.Request)
 	return nil
 }
 
+type clientColls struct {
+	html.TemplateData
+	Colls []*ordersystem.Collection
+}
+
+// clientCollsGet lists the collections which the session is logged in to. Deleted and revoked collections are removed from the session.
+func (srv *Server) clientCollsGet(w http.ResponseWriter, r *http.Request) error {
+	var colls []*ordersystem.Collection
+	for _, collID := range srv.sessionCollIDs(r.Context()) {
+		coll, err := srv.DB.ReadColl(collID)
+		if errors.Is(err, sql.ErrNoRows) {
+			srv.removeColl(r.Context(), collID)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if valid, err := srv.sessionValid(r.Context(), ordersystem.ClientSession, collID); err != nil {
+			return err
+		} else if !valid {
+			srv.removeColl(r.Context(), collID)
+			continue
+		}
+		colls = append(colls, coll)
+	}
+	slices.Reverse(colls) // current collection first
+	return html.ClientColls.Execute(w, clientColls{
+		TemplateData: srv.MakeTemplateData(r), // after removals
+		Colls:        colls,
+	})
+}
+
+// clientCollLogoutPost logs the session out of one collection.
+func (srv *Server) clientCollLogoutPost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	if err := srv.logoutClient(r.Context(), coll.ID); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/collections", http.StatusSeeOther)
+	return nil
+}
+
 func (srv *Server) clientCollLoginGet(w http.ResponseWriter, r *http.Request) error {
 	return html.ClientCollLogin.Execute(w, &clientLogin{
 		TemplateData: srv.MakeTemplateData(r),
@@ -489,25 +699,66 @@ func (srv *Server) clientCollLoginPost(w http.ResponseWriter, r *http.Request) e
 		data.CollIDErr = true
 		return html.ClientCollLogin.Execute(w, data)
 	}
+
+	guard, err := srv.guardLogin(r, ordersystem.CollLoginKey(id))
+	if err != nil {
+		return err
+	}
+	if guard.locked() {
+		data.LockedUntil = guard.LockedUntil.Format("15:04")
+		return html.ClientCollLogin.Execute(w, data)
+	}
+	if !guard.verifyCaptcha(r) {
+		data.Captcha = captcha.TemplateData{
+			ID:  captcha.New(), // old captcha has been deleted during verification
+			Err: true,
+		}
+		return html.ClientCollLogin.Execute(w, data)
+	}
+
 	var pass = strings.TrimSpace(r.PostFormValue("collection-passphrase"))
-	var coll, err = srv.DB.ReadCollPass(id, pass)
+	coll, err := srv.DB.ReadCollPass(id, pass)
 	if err != nil {
 		data.CollPassErr = true
+		data.Captcha, err = srv.loginFailed(guard)
+		if err != nil {
+			return err
+		}
 		return html.ClientCollLogin.Execute(w, data)
 	}
+	if err := srv.loginSucceeded(guard); err != nil {
+		return err
+	}
 
-	srv.loginClient(r.Context(), coll.ID)
+	if err := srv.loginClient(r.Context(), coll.ID); err != nil {
+		return err
+	}
 	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
 	return nil
 }
 
 func (srv *Server) clientCollViewGet(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	refunds, err := srv.DB.ReadRefunds(coll.ID)
+	if err != nil {
+		return err
+	}
+	feedToken, err := srv.DB.ReadFeedToken(coll.ID)
+	if err != nil {
+		return err
+	}
+	sessions, err := srv.DB.ReadSubjectSessions(ordersystem.ClientSession, coll.ID)
+	if err != nil {
+		return err
+	}
 	return html.ClientCollView.Execute(w, collView{
 		TemplateData:  srv.MakeTemplateData(r),
 		Actor:         ordersystem.Client,
 		Collection:    coll,
 		ReadOnly:      true,
 		Notifications: srv.notifications(r.Context()),
+		Refunds:       refunds,
+		FeedLink:      srv.feedLink(feedToken),
+		OtherSessions: len(sessions) - 1, // minus this one
 	})
 }
 
@@ -578,8 +829,10 @@ func (srv *Server) clientCollDeletePost(w http.ResponseWriter, r *http.Request,
 		return err
 	}
 
-	srv.logout(r.Context())
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	if err := srv.logoutClient(r.Context(), coll.ID); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/current", http.StatusSeeOther)
 	return nil
 }
 
@@ -653,6 +906,12 @@ func (srv *Server) clientCollPayBTCPayPost(w http.ResponseWriter, r *http.Reques
 		return fmt.Errorf("creating invoice: %w", err)
 	}
 
+	// remember invoice, so the bot can book it if the webhook is missed
+
+	if err := srv.DB.CreateInvoice(inv.ID, coll.ID); err != nil {
+		return err
+	}
+
 	// add event
 
 	if err := srv.DB.CreateEvent(ordersystem.Client, coll, 0, fmt.Sprintf("Rechnung für Kryptowährungen erzeugt: [%s](%s)", inv.ID, inv.CheckoutLink)); err != nil {
@@ -682,10 +941,63 @@ func (srv *Server) clientCollMessagePost(w http.ResponseWriter, r *http.Request,
 	if !coll.ClientCan("message") {
 		return ErrNotFound
 	}
-	if err := srv.DB.CreateEvent(ordersystem.Client, coll, 0, r.PostFormValue("message")); err != nil {
+	files, err := readAttachments(r)
+	if err != nil {
+		srv.clientError(w, r, err.Error())
+		return nil
+	}
+	if err := srv.DB.CreateEventWithAttachments(ordersystem.Client, coll, 0, r.PostFormValue("message"), files); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
+	return nil
+}
+
+func (srv *Server) clientCollNotificationsPost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	if !coll.CanChangeNotifications() {
+		return ErrNotFound
+	}
+	coll.NotificationsOptOut = r.PostFormValue("notifications") != "on"
+	if err := srv.DB.UpdateCollAndTasks(coll); err != nil {
 		return err
 	}
+	if coll.NotificationsOptOut {
+		srv.notify(r.Context(), "Du erhältst keine Benachrichtigungen mehr.")
+	} else {
+		srv.notify(r.Context(), "Du erhältst wieder Benachrichtigungen.")
+	}
+	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
+	return nil
+}
 
+// clientCollPriceChangePost approves or rejects the pending price change of the store.
+func (srv *Server) clientCollPriceChangePost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	if coll.PendingPriceChange() == nil || !coll.ClientCan("message") {
+		return ErrNotFound
+	}
+	// the store might have replaced the price change since the form was loaded
+	if r.PostFormValue("sum") != strconv.Itoa(coll.PriceChange.Sum()) {
+		srv.notify(r.Context(), "Die Preisänderung wurde inzwischen aktualisiert. Bitte prüfe sie erneut.")
+		http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
+		return nil
+	}
+	var message string
+	switch r.PostFormValue("action") {
+	case "approve":
+		if err := coll.ApplyPriceChange(); err != nil {
+			return err
+		}
+		message = fmt.Sprintf("Ich stimme der Preisänderung zu. Neue Gesamtsumme: %s", html.FmtEuro(coll.Sum()))
+	case "reject":
+		coll.PriceChange = nil
+		message = "Ich lehne die Preisänderung ab."
+	default:
+		return ErrNotFound
+	}
+	if err := srv.DB.UpdateCollAndTasksWithEvent(ordersystem.Client, coll, message); err != nil {
+		return err
+	}
 	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
 	return nil
 }
@@ -730,26 +1042,99 @@ func (data *clientState) Valid() bool {
 	return !data.Captcha.Err && !data.CollIDErr
 }
 
+// rpc receives BTCPay webhooks. Each verified webhook is stored in the inbox before it is processed.
+// If processing fails, we respond with a 5xx status code, so BTCPay will redeliver it.
+// Deliveries with a wrong signature or store ID are stored apart and get a 4xx status code.
 func (srv *Server) rpc(w http.ResponseWriter, r *http.Request) {
 
 	// do verbose logging with webhook stuff
 	log.Println("rpc")
 
-	var event, err = srv.BtcPayStore.ProcessWebhook(r)
+	// ProcessWebhook consumes the body, so we read it first in order to store it
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1024*1024))
+	if err != nil {
+		log.Printf("error reading webhook body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	if err := verifyWebhook(srv.BtcPayStore, r, body); err != nil {
+		log.Printf("rejecting webhook: %v", err)
+		if err := srv.rejectWebhook(err, body); err != nil {
+			log.Printf("error storing rejected webhook: %v", err)
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	event, err := srv.BtcPayStore.ProcessWebhook(r)
 	if err != nil {
 		log.Printf("error processing webhook: %v", err)
+		w.WriteHeader(http.StatusInternalServerError) // might be transient, e.g. if the payment methods could not be fetched
+		return
+	}
+
+	// A redelivery gets a new delivery ID, so we use the original one as idempotency key.
+	var deliveryID = event.DeliveryID
+	if event.OriginalDeliveryID != "" {
+		deliveryID = event.OriginalDeliveryID
+	}
+
+	wh, err := srv.DB.CreateWebhook(deliveryID, event.InvoiceID, string(event.Type), string(body))
+	if err != nil {
+		log.Printf("error storing webhook: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if wh.Status == ordersystem.WebhookProcessed {
+		log.Printf("  skipping delivery %s, it has been processed already", deliveryID)
 		return
 	}
 
+	if err := srv.processWebhook(wh); err != nil {
+		log.Printf("  %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// processWebhook processes a stored webhook and records the result.
+func (srv *Server) processWebhook(wh *ordersystem.Webhook) error {
+	srv.paymentMutex.Lock()
+	defer srv.paymentMutex.Unlock()
+
+	var event = &btcpay.InvoiceEvent{}
+	var err = json.Unmarshal([]byte(wh.Payload), event)
+	if err == nil {
+		err = srv.processInvoiceEvent(event)
+	}
+	if updateErr := srv.DB.UpdateWebhook(wh, err); updateErr != nil {
+		return fmt.Errorf("error updating webhook %d: %w", wh.ID, updateErr)
+	}
+	return err
+}
+
+func (srv *Server) processInvoiceEvent(event *btcpay.InvoiceEvent) error {
+
 	log.Printf("  event: %s", event.Type)
 	log.Printf("  invoice: %s", event.InvoiceID)
 
+	if event.Type == btcpay.EventInvoiceExpired && !event.PartiallyPaid {
+		log.Printf("  skipping event: %s without payment", event.Type)
+		return nil
+	}
+	if event.Type != btcpay.EventInvoiceReceivedPayment && event.Type != btcpay.EventInvoiceSettled && event.Type != btcpay.EventInvoiceExpired {
+		log.Printf("  skipping event: %s", event.Type)
+		return nil
+	}
+
 	// get invoice via bitpay-API, so we know the collection ID, the invoice amount and the rate at the time of payment creation
 
 	invoice, err := srv.BitpayClient.GetInvoice(event.InvoiceID)
 	if err != nil {
-		log.Printf("error getting invoice: %v", err)
-		return
+		return fmt.Errorf("error getting invoice: %w", err)
 	}
 
 	log.Printf("  collection: %s", invoice.OrderID)
@@ -758,8 +1143,7 @@ func (srv *Server) rpc(w http.ResponseWriter, r *http.Request) {
 
 	coll, err := srv.DB.ReadColl(invoice.OrderID)
 	if err != nil {
-		log.Printf("error reading collection %s: %v", invoice.OrderID, err)
-		return
+		return fmt.Errorf("error reading collection %s: %w", invoice.OrderID, err)
 	}
 
 	// If the ordersystem books a payment in Euro (adding a log event with "paid > 0"), then we must be absolutely sure that the BtcTransmuter will sell the same amount of cryptocurrency.
@@ -783,9 +1167,7 @@ func (srv *Server) rpc(w http.ResponseWriter, r *http.Request) {
 		// The "ExpirationMinutes" limit refers to this.
 		//
 		// Let's notify the user that her payment has been seen.
-		if err := srv.invoiceReceivedPayment(event, coll, invoice); err != nil {
-			log.Printf("  %v", err)
-		}
+		return srv.invoiceReceivedPayment(event, coll, invoice)
 	case btcpay.EventInvoiceSettled:
 		// https://github.com/btcpayserver/btcpayserver/issues/2294#issuecomment-780574177
 		// "once a payment is confirmed, it is considered settled"
@@ -802,13 +1184,12 @@ func (srv *Server) rpc(w http.ResponseWriter, r *http.Request) {
 		// Risk: the hook arrives late or is redelivered manually, and late payments are added to the booking sum.
 		//
 		// We assume that "invoice settled" happens after "payment received" hooks.
-		if err := srv.invoiceSettled(coll, invoice); err != nil {
-			log.Printf("  %v", err)
-		}
-	default:
-		log.Printf("  skipping event: %s", event.Type)
-		return
+		return srv.invoiceSettled(coll, invoice)
+	case btcpay.EventInvoiceExpired:
+		// The invoice has been paid partially. The payments are sold at the exchange, but the store staff must book them manually.
+		return srv.invoiceExpiredPartially(coll, invoice)
 	}
+	return nil
 }
 
 func (srv *Server) invoiceReceivedPayment(event *btcpay.InvoiceEvent, coll *ordersystem.Collection, invoice *bitpay.Invoice) error {
@@ -816,11 +1197,7 @@ func (srv *Server) invoiceReceivedPayment(event *btcpay.InvoiceEvent, coll *orde
 	// calculate fiat amount
 
 	var paidCentsInTime int
-	type cryptoAmount struct {
-		Amount   float64
-		Currency string
-	}
-	var paidLate = []cryptoAmount{} // not Euro cents, don't rely on exchange rate any more if paid late
+	var paidLate = []*ordersystem.PaymentReview{} // not Euro cents, don't rely on exchange rate any more if paid late
 
 	for _, crypto := range invoice.CryptoInfo {
 		for _, payment := range crypto.Payments {
@@ -828,40 +1205,88 @@ func (srv *Server) invoiceReceivedPayment(event *btcpay.InvoiceEvent, coll *orde
 				continue // already in event log
 			}
 			if event.AfterExpiration {
-				paidLate = append(paidLate, cryptoAmount{payment.Value, crypto.CryptoCode})
+				paidLate = append(paidLate, &ordersystem.PaymentReview{
+					CollID:       coll.ID,
+					InvoiceID:    invoice.ID,
+					PaymentID:    payment.ID,
+					Kind:         ordersystem.ReviewLate,
+					CryptoCode:   crypto.CryptoCode,
+					CryptoAmount: payment.Value,
+					Rate:         crypto.Rate,
+				})
 				coll.ReceivedLatePayments = append(coll.ReceivedLatePayments, payment.ID)
 			} else {
 				paidCentsInTime += int(math.Round(payment.Value * crypto.Rate * 100.0))
-				coll.ReceivedInTimePayments = append(coll.ReceivedLatePayments, payment.ID)
+				coll.ReceivedInTimePayments = append(coll.ReceivedInTimePayments, payment.ID)
 			}
 		}
 	}
 
-	// first and foremost, write modified ReceivedInTimePayments and ReceivedLatePayments to database
-	if err := srv.DB.UpdateCollAndTasks(coll); err != nil {
-		return fmt.Errorf("error updating collection: %v", err)
+	var messages []string
+	if paidCentsInTime > 0 {
+		messages = append(messages, fmt.Sprintf("Rechnung [%s](%s): Vorläufiger Zahlungseingang: %s. Die Zahlung wird verbucht, sobald das Netzwerk die Transaktion bestätigt.", invoice.ID, srv.BitpayClient.InvoiceURL(invoice), html.FmtEuro(paidCentsInTime)))
+	}
+	for _, pl := range paidLate {
+		// the store staff must book it manually
+		messages = append(messages, fmt.Sprintf("Rechnung [%s](%s): Verspäterer vorläufiger Zahlungseingang: %f %s. Da wir den Umrechnungskurs nicht mehr garantieren können, werden wir die Transaktion manuell prüfen.", invoice.ID, srv.BitpayClient.InvoiceURL(invoice), pl.CryptoAmount, pl.CryptoCode))
 	}
 
-	if paidCentsInTime > 0 {
-		if err := srv.DB.CreateEvent(ordersystem.Bot, coll, 0, fmt.Sprintf("Rechnung [%s](%s): Vorläufiger Zahlungseingang: %s. Die Zahlung wird verbucht, sobald das Netzwerk die Transaktion bestätigt.", invoice.ID, srv.BitpayClient.InvoiceURL(invoice), html.FmtEuro(paidCentsInTime))); err != nil {
-			return fmt.Errorf("error updating collection log: %v", err)
-		}
+	// write modified ReceivedInTimePayments and ReceivedLatePayments together with the review queue entries and the messages
+	if err := srv.DB.ReceivePayments(coll, paidLate, messages); err != nil {
+		return fmt.Errorf("error recording received payments: %v", err)
 	}
+	return nil
+}
 
-	for _, pl := range paidLate {
-		// TODO notify store
-		if err := srv.DB.CreateEvent(ordersystem.Bot, coll, 0, fmt.Sprintf("Rechnung [%s](%s): Verspäterer vorläufiger Zahlungseingang: %f %s. Da wir den Umrechnungskurs nicht mehr garantieren können, werden wir die Transaktion manuell prüfen.", invoice.ID, srv.BitpayClient.InvoiceURL(invoice), pl.Amount, pl.Currency)); err != nil {
-			return fmt.Errorf("error updating collection state: %v", err)
+// invoiceExpiredPartially adds the payments of a partially paid invoice to the review queue.
+// They have been received in time, but they will never be booked by invoiceSettled.
+// It is called by the webhook and by the reconciliation, so it writes an event only if it has added a payment.
+func (srv *Server) invoiceExpiredPartially(coll *ordersystem.Collection, invoice *bitpay.Invoice) error {
+
+	if booked, err := srv.DB.InvoiceBooked(coll, invoice.ID); err != nil {
+		return err
+	} else if booked {
+		return nil
+	}
+
+	var added = 0
+	for _, crypto := range invoice.CryptoInfo {
+		for _, payment := range crypto.Payments {
+			if coll.PaymentHasBeenReceivedLate(payment.ID) {
+				continue // in review queue already
+			}
+			created, err := srv.DB.CreatePaymentReview(&ordersystem.PaymentReview{
+				CollID:       coll.ID,
+				InvoiceID:    invoice.ID,
+				PaymentID:    payment.ID,
+				Kind:         ordersystem.ReviewPartial,
+				CryptoCode:   crypto.CryptoCode,
+				CryptoAmount: payment.Value,
+				Rate:         crypto.Rate,
+			})
+			if err != nil {
+				return fmt.Errorf("error adding payment to review queue: %v", err)
+			}
+			if created {
+				added++ // else the webhook and the reconciliation have both seen it
+			}
 		}
 	}
 
-	return nil
+	if added == 0 {
+		return nil
+	}
+
+	return srv.DB.CreateEvent(ordersystem.Bot, coll, 0, fmt.Sprintf("Rechnung [%s](%s) ist abgelaufen, bevor der volle Betrag eingegangen ist. Wir werden die Zahlung manuell prüfen.", invoice.ID, srv.BitpayClient.InvoiceURL(invoice)))
 }
 
 func (srv *Server) invoiceSettled(coll *ordersystem.Collection, invoice *bitpay.Invoice) error {
 
-	if coll.InvoiceHasBeenBooked(invoice.ID) {
-		return fmt.Errorf("invoice %s has already been booked", invoice.ID)
+	if booked, err := srv.DB.InvoiceBooked(coll, invoice.ID); err != nil {
+		return err
+	} else if booked {
+		log.Printf("  invoice %s has already been booked", invoice.ID)
+		return nil // idempotent
 	}
 
 	// calculate fiat amount
@@ -894,14 +1319,13 @@ func (srv *Server) invoiceSettled(coll *ordersystem.Collection, invoice *bitpay.
 		}
 	}
 
-	coll.BookedInvoices = append(coll.BookedInvoices, invoice.ID)
-
-	// first and foremost, write modified BookedInvoices to database
-	if err := srv.DB.UpdateCollAndTasks(coll); err != nil {
-		return fmt.Errorf("error updating collection: %v", err)
+	// the invoice row is marked as booked in the same transaction, so a concurrent or repeated booking fails
+	err := srv.DB.BookInvoice(invoice.ID, coll, paidCentsInTime, fmt.Sprintf("Rechnung [%s](%s): Zahlungseingang wurde bestätigt: %s.", invoice.ID, srv.BitpayClient.InvoiceURL(invoice), html.FmtEuro(paidCentsInTime)))
+	if errors.Is(err, ordersystem.ErrInvoiceBooked) {
+		log.Printf("  invoice %s has already been booked", invoice.ID)
+		return nil
 	}
-
-	return srv.DB.UpdateCollState(ordersystem.Bot, coll, ordersystem.Active, paidCentsInTime, fmt.Sprintf("Rechnung [%s](%s): Zahlungseingang wurde bestätigt: %s.", invoice.ID, srv.BitpayClient.InvoiceURL(invoice), html.FmtEuro(paidCentsInTime)))
+	return err
 }
 
 // no Collection instances involved
@@ -922,7 +1346,7 @@ func (srv *Server) clientStatePost(w http.ResponseWriter, r *http.Request) error
 		CollID:       strings.TrimSpace(r.PostFormValue("collection-id")),
 	}
 
-	if data.CollID == data.AuthorizedCollID {
+	if slices.Contains(data.AuthorizedCollIDs, data.CollID) {
 		http.Redirect(w, r, fmt.Sprintf("/collection/%s", data.CollID), http.StatusSeeOther)
 		return nil
 	}
@@ -952,22 +1376,74 @@ func (srv *Server) clientLogoutPost(w http.ResponseWriter, r *http.Request) erro
 	return nil
 }
 
+type storeIndex struct {
+	html.TemplateData
+	*ordersystem.DB
+	Mine          string // if set, only collections which have been claimed by this store user are shown
+	Notifications []string
+	Unread        int
+}
+
+// Colls returns the collections in the given state.
+func (index storeIndex) Colls(state ordersystem.CollState) ([]*ordersystem.Collection, error) {
+	ids, err := index.ReadColls(state)
+	if err != nil {
+		return nil, err
+	}
+	var colls []*ordersystem.Collection
+	for _, id := range ids {
+		coll, err := index.ReadColl(id)
+		if err != nil {
+			return nil, err
+		}
+		if index.Mine != "" && coll.Assignee != index.Mine {
+			continue
+		}
+		colls = append(colls, coll)
+	}
+	return colls, nil
+}
+
 func (srv *Server) storeIndexGet(w http.ResponseWriter, r *http.Request) error {
-	return html.StoreIndex.Execute(w, struct {
-		*ordersystem.DB
-		Notifications []string
-	}{
+	settings, err := srv.DB.ReadStaffSettings(srv.sessionUsername(r))
+	if err != nil {
+		return err
+	}
+	unread, err := srv.staffFeed(settings, settings.LastRead)
+	if err != nil {
+		return err
+	}
+	var index = storeIndex{
+		TemplateData:  srv.storeTemplateData(r),
 		DB:            srv.DB,
 		Notifications: srv.notifications(r.Context()),
-	})
+		Unread:        len(unread),
+	}
+	if r.URL.Query().Get("mine") != "" {
+		index.Mine = srv.sessionUsername(r)
+	}
+	return html.StoreIndex.Execute(w, index)
 }
 
 func (srv *Server) storeCollViewGet(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
-	return html.StoreCollView.Execute(w, collView{
-		Actor:         ordersystem.Store,
-		Collection:    coll,
-		ReadOnly:      true,
-		Notifications: srv.notifications(r.Context()),
+	refunds, err := srv.DB.ReadRefunds(coll.ID)
+	if err != nil {
+		return err
+	}
+	sendLog, err := srv.DB.ReadNotifications(coll.ID)
+	if err != nil {
+		return err
+	}
+	return html.StoreCollView.Execute(w, collView{
+		TemplateData:  srv.storeTemplateData(r),
+		Actor:         ordersystem.Store,
+		Collection:    coll,
+		ReadOnly:      true,
+		Notifications: srv.notifications(r.Context()),
+		Refunds:       refunds,
+		Role:          srv.sessionRole(r),
+		SendLog:       sendLog,
+		Username:      srv.sessionUsername(r),
 	})
 }
 
@@ -975,13 +1451,17 @@ func (srv *Server) storeCollAcceptGet(w http.ResponseWriter, r *http.Request, co
 	if !coll.StoreCan("accept") {
 		return ErrNotFound
 	}
-	return html.StoreCollAccept.Execute(w, coll)
+	return html.StoreCollAccept.Execute(w, collView{TemplateData: srv.storeTemplateData(r), Collection: coll})
 }
 
 func (srv *Server) storeCollAcceptPost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
 	if !coll.StoreCan("accept") {
 		return ErrNotFound
 	}
+	if coll.ExceedsMaxTotal() {
+		srv.storeError(w, r, fmt.Sprintf("Die Gesamtsumme von %s überschreitet das Budget des Kunden von %s. Bitte passe den Auftrag an oder sprich dich mit dem Kunden ab.", html.FmtEuro(coll.Sum()), html.FmtEuro(coll.MaxTotal)))
+		return nil
+	}
 	if err := srv.DB.UpdateCollState(ordersystem.Store, coll, ordersystem.Accepted, 0, r.PostFormValue("accept-message")); err != nil {
 		return err
 	}
@@ -994,7 +1474,7 @@ func (srv *Server) storeCollActivateGet(w http.ResponseWriter, r *http.Request,
 	if !coll.StoreCan("activate") {
 		return ErrNotFound
 	}
-	return html.StoreCollActivate.Execute(w, coll)
+	return html.StoreCollActivate.Execute(w, collView{TemplateData: srv.storeTemplateData(r), Collection: coll})
 }
 
 func (srv *Server) storeCollActivatePost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
@@ -1013,7 +1493,7 @@ func (srv *Server) storeCollDeleteGet(w http.ResponseWriter, r *http.Request, co
 	if !coll.StoreCan("delete") {
 		return ErrNotFound
 	}
-	return html.StoreCollDelete.Execute(w, &collDelete{Collection: coll})
+	return html.StoreCollDelete.Execute(w, &collDelete{TemplateData: srv.storeTemplateData(r), Collection: coll})
 }
 
 func (srv *Server) storeCollDeletePost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
@@ -1022,8 +1502,9 @@ func (srv *Server) storeCollDeletePost(w http.ResponseWriter, r *http.Request, c
 	}
 	if r.PostFormValue("confirm-delete") == "" {
 		return html.StoreCollDelete.Execute(w, &collDelete{
-			Collection: coll,
-			Err:        true,
+			TemplateData: srv.storeTemplateData(r),
+			Collection:   coll,
+			Err:          true,
 		})
 	}
 	if err := srv.DB.Delete(ordersystem.Store, coll); err != nil {
@@ -1038,8 +1519,9 @@ func (srv *Server) storeTaskConfirmArrivedGet(w http.ResponseWriter, r *http.Req
 		return ErrNotFound
 	}
 	return html.StoreTaskConfirmArrived.Execute(w, html.TaskView{
-		Task:       task,
-		Collection: coll,
+		TemplateData: srv.storeTemplateData(r),
+		Task:         task,
+		Collection:   coll,
 	})
 }
 
@@ -1059,8 +1541,9 @@ func (srv *Server) storeTaskConfirmOrderedGet(w http.ResponseWriter, r *http.Req
 		return ErrNotFound
 	}
 	return html.StoreTaskConfirmOrdered.Execute(w, html.TaskView{
-		Task:       task,
-		Collection: coll,
+		TemplateData: srv.storeTemplateData(r),
+		Task:         task,
+		Collection:   coll,
 	})
 }
 
@@ -1080,8 +1563,9 @@ func (srv *Server) storeTaskMarkFailedGet(w http.ResponseWriter, r *http.Request
 		return ErrNotFound
 	}
 	return html.StoreTaskMarkFailed.Execute(w, html.TaskView{
-		Task:       task,
-		Collection: coll,
+		TemplateData: srv.storeTemplateData(r),
+		Task:         task,
+		Collection:   coll,
 	})
 }
 
@@ -1109,7 +1593,7 @@ func (srv *Server) storeCollConfirmPaymentGet(w http.ResponseWriter, r *http.Req
 	if !coll.StoreCan("confirm-payment") {
 		return ErrNotFound
 	}
-	return html.StoreCollConfirmPayment.Execute(w, storeCollConfirmPayment{Coll: coll})
+	return html.StoreCollConfirmPayment.Execute(w, storeCollConfirmPayment{TemplateData: srv.storeTemplateData(r), Coll: coll})
 }
 
 func (srv *Server) storeCollConfirmPaymentPost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
@@ -1121,8 +1605,9 @@ func (srv *Server) storeCollConfirmPaymentPost(w http.ResponseWriter, r *http.Re
 	var paidAmountFloat, err = strconv.ParseFloat(r.PostFormValue("paid-amount"), 64)
 	if err != nil {
 		return html.StoreCollConfirmPayment.Execute(w, storeCollConfirmPayment{
-			Coll: coll,
-			Err:  true,
+			TemplateData: srv.storeTemplateData(r),
+			Coll:         coll,
+			Err:          true,
 		})
 	}
 
@@ -1139,7 +1624,7 @@ func (srv *Server) storeCollConfirmPaymentPost(w http.ResponseWriter, r *http.Re
 		return err
 	}
 
-	botCollIDs <- coll.ID
+	srv.EnqueueBot(coll.ID)
 
 	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
 	return nil
@@ -1149,7 +1634,7 @@ func (srv *Server) storeCollConfirmPickupGet(w http.ResponseWriter, r *http.Requ
 	if !coll.StoreCan("confirm-pickup") {
 		return ErrNotFound
 	}
-	return html.StoreCollConfirmPickup.Execute(w, coll)
+	return html.StoreCollConfirmPickup.Execute(w, collView{TemplateData: srv.storeTemplateData(r), Collection: coll})
 }
 
 func (srv *Server) storeCollConfirmPickupPost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
@@ -1175,7 +1660,7 @@ func (srv *Server) storeCollConfirmPickupPost(w http.ResponseWriter, r *http.Req
 		}
 	}
 
-	botCollIDs <- coll.ID
+	srv.EnqueueBot(coll.ID)
 
 	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
 	return nil
@@ -1185,7 +1670,7 @@ func (srv *Server) storeCollConfirmReshippedGet(w http.ResponseWriter, r *http.R
 	if !coll.StoreCan("confirm-reshipped") {
 		return ErrNotFound
 	}
-	return html.StoreCollConfirmReshipped.Execute(w, coll)
+	return html.StoreCollConfirmReshipped.Execute(w, collView{TemplateData: srv.storeTemplateData(r), Collection: coll})
 }
 
 func (srv *Server) storeCollConfirmReshippedPost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
@@ -1211,7 +1696,7 @@ func (srv *Server) storeCollConfirmReshippedPost(w http.ResponseWriter, r *http.
 		}
 	}
 
-	botCollIDs <- coll.ID
+	srv.EnqueueBot(coll.ID)
 
 	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
 	return nil
@@ -1222,8 +1707,9 @@ func (srv *Server) storeTaskConfirmPickupGet(w http.ResponseWriter, r *http.Requ
 		return ErrNotFound
 	}
 	return html.StoreTaskConfirmPickup.Execute(w, html.TaskView{
-		Task:       task,
-		Collection: coll,
+		TemplateData: srv.storeTemplateData(r),
+		Task:         task,
+		Collection:   coll,
 	})
 }
 
@@ -1236,7 +1722,7 @@ func (srv *Server) storeTaskConfirmPickupPost(w http.ResponseWriter, r *http.Req
 	}
 	srv.notify(r.Context(), "Einzelbestellung %s wurde als abgeholt markiert", task.ID)
 
-	botCollIDs <- coll.ID
+	srv.EnqueueBot(coll.ID)
 
 	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
 	return nil
@@ -1247,8 +1733,9 @@ func (srv *Server) storeTaskConfirmReshippedGet(w http.ResponseWriter, r *http.R
 		return ErrNotFound
 	}
 	return html.StoreTaskConfirmReshipped.Execute(w, html.TaskView{
-		Task:       task,
-		Collection: coll,
+		TemplateData: srv.storeTemplateData(r),
+		Task:         task,
+		Collection:   coll,
 	})
 }
 
@@ -1261,7 +1748,7 @@ func (srv *Server) storeTaskConfirmReshippedPost(w http.ResponseWriter, r *http.
 	}
 	srv.notify(r.Context(), "Einzelbestellung %s wurde als weiterverschickt markiert", task.ID)
 
-	botCollIDs <- coll.ID
+	srv.EnqueueBot(coll.ID)
 
 	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
 	return nil
@@ -1272,8 +1759,11 @@ func (srv *Server) storeCollEditGet(w http.ResponseWriter, r *http.Request, coll
 		return ErrNotFound
 	}
 	return html.StoreCollEdit.Execute(w, collView{
-		Actor:      ordersystem.Store,
-		Collection: coll,
+		TemplateData: srv.storeTemplateData(r),
+		Actor:        ordersystem.Store,
+		Collection:   coll,
+		Role:         srv.sessionRole(r),
+		Username:     srv.sessionUsername(r),
 	})
 }
 
@@ -1326,14 +1816,36 @@ func (srv *Server) storeCollEditPost(w http.ResponseWriter, r *http.Request, col
 	input.DeliveryAddress.Postcode = data.ShippingPostcode
 	input.DeliveryAddress.City = data.ShippingTown
 	input.Tasks = data.Tasks
+
+	var old = *coll // copy, Merge modifies the task list in place
+	old.Tasks = slices.Clone(coll.Tasks)
 	if err := coll.Merge(ordersystem.Store, &input); err != nil {
 		return err
 	}
-	if err := srv.DB.UpdateCollAndTasks(coll); err != nil {
-		return err
+	var needsApproval = coll.DeferPriceChange(&old, srv.DB.Config.PriceChangeTolerance, srv.sessionUsername(r))
+	if !needsApproval && coll.ExceedsMaxTotal() {
+		srv.storeError(w, r, fmt.Sprintf("Die Gesamtsumme von %s überschreitet das Budget des Kunden von %s. Die Änderungen wurden nicht gespeichert.", html.FmtEuro(coll.Sum()), html.FmtEuro(coll.MaxTotal)))
+		return nil
+	}
+	if needsApproval {
+		var message = fmt.Sprintf("Die Preise haben sich geändert. Die neue Gesamtsumme wäre %s statt %s. Bitte stimme der Änderung auf der Auftragsseite zu oder lehne sie ab.", html.FmtEuro(coll.PriceChange.Sum()), html.FmtEuro(coll.Sum()))
+		if coll.PriceChange.ExceedsMaxTotal(coll) {
+			message += fmt.Sprintf(" Sie überschreitet dein Budget von %s.", html.FmtEuro(coll.MaxTotal))
+		}
+		if err := srv.DB.UpdateCollAndTasksWithEvent(ordersystem.Store, coll, message); err != nil {
+			return err
+		}
+		if coll.PriceChange.ExceedsMaxTotal(coll) {
+			srv.notify(r.Context(), "Deine Änderungen am Auftrag %s wurden gespeichert. Die neue Gesamtsumme überschreitet das Budget des Kunden von %s. Die Preisänderung gilt erst, wenn der Kunde zustimmt.", coll.ID, html.FmtEuro(coll.MaxTotal))
+		} else {
+			srv.notify(r.Context(), "Deine Änderungen am Auftrag %s wurden gespeichert. Die Preisänderung gilt erst, wenn der Kunde zustimmt.", coll.ID)
+		}
+	} else {
+		if err := srv.DB.UpdateCollAndTasks(coll); err != nil {
+			return err
+		}
+		srv.notify(r.Context(), "Deine Änderungen am Auftrag %s wurden gespeichert.", coll.ID)
 	}
-
-	srv.notify(r.Context(), "Deine Änderungen am Auftrag %s wurden gespeichert.", coll.ID)
 	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
 	return nil
 }
@@ -1342,16 +1854,111 @@ func (srv *Server) storeCollMessageGet(w http.ResponseWriter, r *http.Request, c
 	if !coll.StoreCan("message") {
 		return ErrNotFound
 	}
-	return html.StoreCollMessage.Execute(w, coll)
+	return html.StoreCollMessage.Execute(w, collView{TemplateData: srv.storeTemplateData(r), Collection: coll})
 }
 
 func (srv *Server) storeCollMessagePost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
 	if !coll.StoreCan("message") {
 		return ErrNotFound
 	}
-	if err := srv.DB.CreateEvent(ordersystem.Store, coll, 0, r.PostFormValue("message")); err != nil {
+	files, err := readAttachments(r)
+	if err != nil {
+		srv.storeError(w, r, err.Error())
+		return nil
+	}
+	if err := srv.DB.CreateEventWithAttachments(ordersystem.Store, coll, 0, r.PostFormValue("message"), files); err != nil {
+		return err
+	}
+	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
+	return nil
+}
+
+type storeCollRefund struct {
+	html.TemplateData
+	Coll       *ordersystem.Collection
+	Refundable int
+	Err        bool
+}
+
+// refundable returns the amount which has been paid and not been refunded yet, including pending refunds.
+func (srv *Server) refundable(coll *ordersystem.Collection) (int, error) {
+	refunds, err := srv.DB.ReadRefunds(coll.ID)
+	if err != nil {
+		return 0, err
+	}
+	var refundable = coll.Paid() // booked payouts are negative payments already
+	for _, refund := range refunds {
+		if refund.Pending() {
+			refundable -= refund.Cents - refund.BookedCents
+		}
+	}
+	return refundable, nil
+}
+
+func (srv *Server) storeCollRefundGet(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	if !coll.StoreCan("refund") {
+		return ErrNotFound
+	}
+	refundable, err := srv.refundable(coll)
+	if err != nil {
+		return err
+	}
+	return html.StoreCollRefund.Execute(w, storeCollRefund{
+		TemplateData: srv.storeTemplateData(r),
+		Coll:         coll,
+		Refundable:   refundable,
+	})
+}
+
+func (srv *Server) storeCollRefundPost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	if !coll.StoreCan("refund") {
+		return ErrNotFound
+	}
+
+	// don't create two pull payments on a double submit, CreateRefund checks the refundable amount again
+	srv.paymentMutex.Lock()
+	defer srv.paymentMutex.Unlock()
+
+	coll, err := srv.DB.ReadColl(coll.ID) // might have changed while we were waiting
+	if err != nil {
 		return err
 	}
+	refundable, err := srv.refundable(coll)
+	if err != nil {
+		return err
+	}
+
+	amount, err := strconv.ParseFloat(r.PostFormValue("refund-amount"), 64)
+	var cents = int(math.Round(amount * 100.0))
+	if err != nil || cents <= 0 || cents > refundable {
+		return html.StoreCollRefund.Execute(w, storeCollRefund{
+			TemplateData: srv.storeTemplateData(r),
+			Coll:         coll,
+			Refundable:   refundable,
+			Err:          true,
+		})
+	}
+
+	pullPayment, err := srv.PullPayments.CreatePullPayment(fmt.Sprintf("Rückerstattung %s", coll.ID), cents)
+	if err != nil {
+		return fmt.Errorf("creating pull payment: %w", err)
+	}
+
+	var refund = &ordersystem.Refund{
+		ID:        pullPayment.ID,
+		Cents:     cents,
+		ClaimLink: pullPayment.ViewLink,
+	}
+	var message = fmt.Sprintf("Rückerstattung über %s wurde angelegt. Du kannst sie auf der Auftragsseite mit einer Kryptowährung deiner Wahl abrufen.", html.FmtEuro(cents))
+	if note := strings.TrimSpace(r.PostFormValue("refund-message")); note != "" {
+		message = message + "\n\n" + note
+	}
+	if err := srv.DB.CreateRefund(refund, coll, message); err != nil {
+		log.Printf("pull payment %s of collection %s has not been stored, please archive it: %v", pullPayment.ID, coll.ID, err)
+		return err
+	}
+
+	srv.notify(r.Context(), "Die Rückerstattung über %s wurde angelegt.", html.FmtEuro(cents))
 	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
 	return nil
 }
@@ -1360,7 +1967,7 @@ func (srv *Server) storeCollReturnGet(w http.ResponseWriter, r *http.Request, co
 	if !coll.StoreCan("return") {
 		return ErrNotFound
 	}
-	return html.StoreCollReturn.Execute(w, coll)
+	return html.StoreCollReturn.Execute(w, collView{TemplateData: srv.storeTemplateData(r), Collection: coll})
 }
 
 func (srv *Server) storeCollReturnPost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
@@ -1385,7 +1992,7 @@ func (srv *Server) storeCollRejectGet(w http.ResponseWriter, r *http.Request, co
 	if !coll.StoreCan("reject") {
 		return ErrNotFound
 	}
-	return html.StoreCollReject.Execute(w, storeCollReject{Coll: coll})
+	return html.StoreCollReject.Execute(w, storeCollReject{TemplateData: srv.storeTemplateData(r), Coll: coll})
 }
 
 func (srv *Server) storeCollRejectPost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
@@ -1394,8 +2001,9 @@ func (srv *Server) storeCollRejectPost(w http.ResponseWriter, r *http.Request, c
 	}
 	if r.PostFormValue("confirm-reject") == "" {
 		return html.StoreCollReject.Execute(w, storeCollReject{
-			Coll: coll,
-			Err:  true,
+			TemplateData: srv.storeTemplateData(r),
+			Coll:         coll,
+			Err:          true,
 		})
 	}
 	if err := srv.DB.UpdateCollState(ordersystem.Store, coll, ordersystem.Rejected, 0, r.PostFormValue("reject-message")); err != nil {
@@ -1415,7 +2023,7 @@ func (srv *Server) storeCollSubmitGet(w http.ResponseWriter, r *http.Request, co
 	if !coll.StoreCan("submit") {
 		return ErrNotFound
 	}
-	return html.StoreCollSubmit.Execute(w, storeCollSubmit{Coll: coll})
+	return html.StoreCollSubmit.Execute(w, storeCollSubmit{TemplateData: srv.storeTemplateData(r), Coll: coll})
 }
 
 func (srv *Server) storeCollSubmitPost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
@@ -1440,7 +2048,7 @@ func (srv *Server) storeCollMarkSpamGet(w http.ResponseWriter, r *http.Request,
 	if !coll.StoreCan("mark-spam") {
 		return ErrNotFound
 	}
-	return html.StoreCollMarkSpam.Execute(w, storeCollMarkSpam{Coll: coll})
+	return html.StoreCollMarkSpam.Execute(w, storeCollMarkSpam{TemplateData: srv.storeTemplateData(r), Coll: coll})
 }
 
 func (srv *Server) storeCollMarkSpamPost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
@@ -1449,8 +2057,9 @@ func (srv *Server) storeCollMarkSpamPost(w http.ResponseWriter, r *http.Request,
 	}
 	if r.PostFormValue("confirm-mark-spam") == "" {
 		return html.StoreCollMarkSpam.Execute(w, storeCollMarkSpam{
-			Coll: coll,
-			Err:  true,
+			TemplateData: srv.storeTemplateData(r),
+			Coll:         coll,
+			Err:          true,
 		})
 	}
 	if err := srv.DB.UpdateCollState(ordersystem.Store, coll, ordersystem.Spam, 0, "Dein Antrag wurde als Spam markiert."); err != nil {
@@ -1461,17 +2070,82 @@ func (srv *Server) storeCollMarkSpamPost(w http.ResponseWriter, r *http.Request,
 	return nil
 }
 
+type storeLogin struct {
+	html.TemplateData
+	Username    string
+	Err         bool
+	Captcha     captcha.TemplateData // if required after failed attempts
+	LockedUntil string
+}
+
 func (srv *Server) storeLoginGet(w http.ResponseWriter, r *http.Request) error {
-	return html.StoreLogin.Execute(w, nil)
+	return html.StoreLogin.Execute(w, storeLogin{TemplateData: srv.storeTemplateData(r)})
 }
 
 func (srv *Server) storeLoginPost(w http.ResponseWriter, r *http.Request) error {
 	username := r.PostFormValue("username")
 	password := r.PostFormValue("password")
+
+	var data = storeLogin{
+		TemplateData: srv.storeTemplateData(r),
+		Username:     username,
+	}
+	guard, err := srv.guardLogin(r, ordersystem.StoreLoginKey(username))
+	if err != nil {
+		return err
+	}
+	if guard.locked() {
+		data.LockedUntil = guard.LockedUntil.Format("15:04")
+		return html.StoreLogin.Execute(w, data)
+	}
+	if !guard.verifyCaptcha(r) {
+		data.Captcha = captcha.TemplateData{
+			ID:  captcha.New(), // old captcha has been deleted during verification
+			Err: true,
+		}
+		return html.StoreLogin.Execute(w, data)
+	}
 	if err := srv.Users.Authenticate(username, password); err != nil {
+		if err := srv.audit(username, ordersystem.AuditLoginFailed, srv.loginSource(r)); err != nil {
+			return err
+		}
+		data.Err = true
+		data.Captcha, err = srv.loginFailed(guard)
+		if err != nil {
+			return err
+		}
+		return html.StoreLogin.Execute(w, data)
+	}
+
+	t, err := srv.DB.ReadTOTP(username)
+	if err != nil && !errors.Is(err, ordersystem.ErrNotFound) {
+		return err
+	}
+	if t != nil && t.Confirmed {
+		// counter is reset after the second step, so it limits TOTP guessing too
+		if err := srv.Sessions.RenewToken(r.Context()); err != nil {
+			return err
+		}
+		srv.Sessions.Put(r.Context(), "totp-username", username)
+		srv.Sessions.Put(r.Context(), "totp-time", time.Now().Unix())
+		http.Redirect(w, r, "/login/totp", http.StatusSeeOther)
+		return nil
+	}
+
+	if err := srv.loginSucceeded(guard); err != nil {
 		return err
 	}
-	srv.loginStore(r.Context(), username)
+	if err := srv.loginStore(r.Context(), username); err != nil {
+		return err
+	}
+	if err := srv.audit(username, ordersystem.AuditLogin, srv.loginSource(r)); err != nil {
+		return err
+	}
+	if srv.DB.Config.RequireTOTP {
+		srv.Sessions.Put(r.Context(), "totp-required", true) // see auth
+		http.Redirect(w, r, "/totp", http.StatusSeeOther)
+		return nil
+	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 	return nil
 }
@@ -1545,7 +2219,188 @@ func (srv *Server) storeExport(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// storeTable is passed to a sub-template which renders a form in each row, so the rows can access the CSRF token.
+type storeTable[T any] struct {
+	html.TemplateData
+	Rows []T
+}
+
+type storeWebhooks struct {
+	html.TemplateData
+	Failed        storeTable[*ordersystem.Webhook]
+	Pending       storeTable[*ordersystem.Webhook]
+	Rejected      []*ordersystem.RejectedWebhook
+	Notifications []string
+}
+
+func (srv *Server) storeWebhooksGet(w http.ResponseWriter, r *http.Request) error {
+	failed, err := srv.DB.ReadWebhooks(ordersystem.WebhookFailed)
+	if err != nil {
+		return err
+	}
+	pending, err := srv.DB.ReadWebhooks(ordersystem.WebhookPending)
+	if err != nil {
+		return err
+	}
+	rejected, err := srv.DB.ReadRejectedWebhooks(rejectedWebhookLimit)
+	if err != nil {
+		return err
+	}
+	return html.StoreWebhooks.Execute(w, storeWebhooks{
+		TemplateData:  srv.storeTemplateData(r),
+		Failed:        storeTable[*ordersystem.Webhook]{srv.storeTemplateData(r), failed},
+		Pending:       storeTable[*ordersystem.Webhook]{srv.storeTemplateData(r), pending},
+		Rejected:      rejected,
+		Notifications: srv.notifications(r.Context()),
+	})
+}
+
+// storeWebhookReplayPost processes a stored webhook again. The signature has been verified when it was received.
+func (srv *Server) storeWebhookReplayPost(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		return ErrNotFound
+	}
+	wh, err := srv.DB.ReadWebhook(id)
+	if err != nil {
+		return err
+	}
+	if wh.Status == ordersystem.WebhookProcessed {
+		return errors.New("webhook has been processed already")
+	}
+	if err := srv.processWebhook(wh); err != nil {
+		srv.notify(r.Context(), "Webhook %d ist erneut fehlgeschlagen: %v", wh.ID, err)
+	} else {
+		srv.notify(r.Context(), "Webhook %d wurde verarbeitet.", wh.ID)
+	}
+	http.Redirect(w, r, "/webhooks", http.StatusSeeOther)
+	return nil
+}
+
+type storeReviews struct {
+	html.TemplateData
+	Open          storeTable[storeReview]
+	RefundPending storeTable[storeReview]
+	Notifications []string
+}
+
+type storeReview struct {
+	*ordersystem.PaymentReview
+	CurrentRate float64 // zero if unknown
+}
+
+func (review storeReview) CurrentCents() int {
+	return int(math.Round(review.CryptoAmount * review.CurrentRate * 100.0))
+}
+
+func (srv *Server) storeReviewsGet(w http.ResponseWriter, r *http.Request) error {
+	var rates = make(map[string]float64) // cache
+	var load = func(status ordersystem.ReviewStatus) ([]storeReview, error) {
+		reviews, err := srv.DB.ReadPaymentReviews(status)
+		if err != nil {
+			return nil, err
+		}
+		var result = make([]storeReview, len(reviews))
+		for i, review := range reviews {
+			rate, ok := rates[review.CryptoCode]
+			if !ok {
+				rate, err = srv.currentRate(review.CryptoCode)
+				if err != nil {
+					log.Printf("error getting %s rate: %v", review.CryptoCode, err)
+				}
+				rates[review.CryptoCode] = rate
+			}
+			result[i] = storeReview{review, rate}
+		}
+		return result, nil
+	}
+	open, err := load(ordersystem.ReviewOpen)
+	if err != nil {
+		return err
+	}
+	refundPending, err := load(ordersystem.ReviewRefundPending)
+	if err != nil {
+		return err
+	}
+	return html.StoreReviews.Execute(w, storeReviews{
+		TemplateData:  srv.storeTemplateData(r),
+		Open:          storeTable[storeReview]{srv.storeTemplateData(r), open},
+		RefundPending: storeTable[storeReview]{srv.storeTemplateData(r), refundPending},
+		Notifications: srv.notifications(r.Context()),
+	})
+}
+
+func (srv *Server) storeReviewPost(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		return ErrNotFound
+	}
+	review, err := srv.DB.ReadPaymentReview(id)
+	if err != nil {
+		return err
+	}
+	coll, err := srv.DB.ReadColl(review.CollID)
+	if err != nil {
+		return err
+	}
+
+	var cents = 0
+	var message string
+	var status = ordersystem.ReviewStatus(r.PostFormValue("status"))
+	switch status {
+	case ordersystem.ReviewBooked:
+		if !coll.StoreCan("confirm-payment") {
+			return fmt.Errorf("collection %s is %s, payments can't be booked", coll.ID, coll.State.Name())
+		}
+		amount, err := strconv.ParseFloat(r.PostFormValue("amount"), 64)
+		if err != nil || amount <= 0 {
+			return errors.New("invalid amount")
+		}
+		cents = int(math.Round(amount * 100.0))
+		message = fmt.Sprintf("Rechnung %s: Zahlungseingang wurde nach manueller Prüfung verbucht: %s.", review.InvoiceID, html.FmtEuro(cents))
+	case ordersystem.ReviewDismissed, ordersystem.ReviewRefundPending:
+	default:
+		return errors.New("invalid status")
+	}
+
+	if err := srv.DB.UpdatePaymentReview(srv.sessionUsername(r), review, coll, status, cents, r.PostFormValue("note"), message); err != nil {
+		return err
+	}
+
+	srv.EnqueueBot(coll.ID)
+
+	srv.notify(r.Context(), "Zahlung %s von Auftrag %s: %s", review.PaymentID, coll.ID, status.Name())
+	http.Redirect(w, r, "/reviews", http.StatusSeeOther)
+	return nil
+}
+
+// currentRate gets the current exchange rate in euro from the BitPay-compatible API of the BTCPay server.
+func (srv *Server) currentRate(cryptoCode string) (float64, error) {
+	resp, err := srv.BitpayClient.DoRequest(http.MethodGet, fmt.Sprintf("rates/%s/EUR", cryptoCode), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("response status: %d", resp.StatusCode)
+	}
+	var result struct {
+		Data struct {
+			Rate float64 `json:"rate"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.Data.Rate, nil
+}
+
 func (srv *Server) storeLogoutPost(w http.ResponseWriter, r *http.Request) error {
+	if username := srv.sessionUsername(r); username != "" {
+		if err := srv.audit(username, ordersystem.AuditLogout, ""); err != nil {
+			return err
+		}
+	}
 	srv.logout(r.Context())
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 	return nil
@@ -1559,8 +2414,251 @@ func (srv *Server) MakeTemplateData(r *http.Request) html.TemplateData {
 			Languages: ssg.LangOptions(srv.Langs, l),
 			Path:      path,
 		},
-		Active:           "order",
-		AuthorizedCollID: srv.sessionCollID(r),
-		Onion:            strings.HasSuffix(r.Host, ".onion") || strings.Contains(r.Host, ".onion:"),
+		Active:            "order",
+		AuthorizedCollID:  srv.sessionCollID(r),
+		AuthorizedCollIDs: srv.sessionCollIDs(r.Context()),
+		Onion:             strings.HasSuffix(r.Host, ".onion") || strings.Contains(r.Host, ".onion:"),
+		CSRFToken: func() string {
+			return srv.csrfToken(r.Context())
+		},
+	}
+}
+
+// storeTemplateData returns the template data for store pages. They use its CSRF token only.
+func (srv *Server) storeTemplateData(r *http.Request) html.TemplateData {
+	return html.TemplateData{
+		CSRFToken: func() string {
+			return srv.csrfToken(r.Context())
+		},
 	}
 }
+
+type storeBotReport struct {
+	html.TemplateData
+	Actions       []ordersystem.BotAction
+	Config        *ordersystem.Config
+	FailedJobs    []*ordersystem.Job
+	Notifications []string
+}
+
+// storeBotReportGet lists the actions which the bot would do.
+func (srv *Server) storeBotReportGet(w http.ResponseWriter, r *http.Request) error {
+	actions, err := srv.DB.BotPlan()
+	if err != nil {
+		return err
+	}
+	failedJobs, err := srv.DB.ReadFailedJobs()
+	if err != nil {
+		return err
+	}
+	return html.StoreBotReport.Execute(w, storeBotReport{
+		TemplateData:  srv.storeTemplateData(r),
+		Actions:       actions,
+		Config:        srv.DB.Config,
+		FailedJobs:    failedJobs,
+		Notifications: srv.notifications(r.Context()),
+	})
+}
+
+func (srv *Server) storeJobRetryPost(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		return ErrNotFound
+	}
+	job, err := srv.DB.ReadJob(id)
+	if err != nil {
+		return err
+	}
+	if err := srv.DB.RetryJob(job, time.Now()); err != nil {
+		return err
+	}
+	srv.wakeJobs()
+	srv.notify(r.Context(), "Job %d wird erneut ausgeführt.", job.ID)
+	http.Redirect(w, r, "/bot-report", http.StatusSeeOther)
+	return nil
+}
+
+type storeInbox struct {
+	html.TemplateData
+	Events        []*ordersystem.StaffEvent
+	Settings      *ordersystem.StaffSettings
+	Notifications []string
+}
+
+func (srv *Server) storeInboxGet(w http.ResponseWriter, r *http.Request) error {
+	settings, err := srv.DB.ReadStaffSettings(srv.sessionUsername(r))
+	if err != nil {
+		return err
+	}
+	events, err := srv.staffFeed(settings, 0)
+	if err != nil {
+		return err
+	}
+	return html.StoreInbox.Execute(w, storeInbox{
+		TemplateData:  srv.storeTemplateData(r),
+		Events:        events,
+		Settings:      settings,
+		Notifications: srv.notifications(r.Context()),
+	})
+}
+
+// storeInboxReadPost marks the feed as read up to the event ID which has been shown, so events which have arrived in the meantime stay unread.
+func (srv *Server) storeInboxReadPost(w http.ResponseWriter, r *http.Request) error {
+	lastID, err := strconv.Atoi(r.PostFormValue("last-id"))
+	if err != nil {
+		return err
+	}
+	settings, err := srv.DB.ReadStaffSettings(srv.sessionUsername(r))
+	if err != nil {
+		return err
+	}
+	if lastID > settings.LastRead {
+		settings.LastRead = lastID
+		if err := srv.DB.UpdateStaffSettings(settings); err != nil {
+			return err
+		}
+	}
+	http.Redirect(w, r, "/inbox", http.StatusSeeOther)
+	return nil
+}
+
+type storeSettings struct {
+	html.TemplateData
+	Kinds         []ordersystem.StaffEventKind
+	Protocols     []string
+	Settings      *ordersystem.StaffSettings
+	Notifications []string
+}
+
+func (srv *Server) storeSettingsGet(w http.ResponseWriter, r *http.Request) error {
+	settings, err := srv.DB.ReadStaffSettings(srv.sessionUsername(r))
+	if err != nil {
+		return err
+	}
+	var protocols []string
+	for _, protocol := range ordersystem.NotificationProtocols {
+		if _, ok := srv.Notifiers[protocol]; ok {
+			protocols = append(protocols, protocol)
+		}
+	}
+	return html.StoreSettings.Execute(w, storeSettings{
+		TemplateData:  srv.storeTemplateData(r),
+		Kinds:         ordersystem.StaffEventKinds,
+		Protocols:     protocols,
+		Settings:      settings,
+		Notifications: srv.notifications(r.Context()),
+	})
+}
+
+func (srv *Server) storeSettingsPost(w http.ResponseWriter, r *http.Request) error {
+	settings, err := srv.DB.ReadStaffSettings(srv.sessionUsername(r))
+	if err != nil {
+		return err
+	}
+
+	settings.Kinds = nil
+	r.ParseForm()
+	for _, kind := range r.PostForm["kind"] {
+		if slices.Contains(ordersystem.StaffEventKinds, ordersystem.StaffEventKind(kind)) {
+			settings.Kinds = append(settings.Kinds, ordersystem.StaffEventKind(kind))
+		}
+	}
+
+	settings.DigestProtocol = r.PostFormValue("digest-protocol")
+	settings.DigestAddress = strings.TrimSpace(r.PostFormValue("digest-address"))
+	if settings.DigestProtocol != "" {
+		if _, ok := srv.Notifiers[settings.DigestProtocol]; !ok {
+			return errors.New("unknown digest protocol")
+		}
+		if settings.DigestAddress == "" {
+			return errors.New("missing digest address")
+		}
+	}
+
+	// don't send the whole history in the first digest
+	if settings.LastDigest == 0 {
+		latest, err := srv.DB.ReadStaffEvents(0, 1)
+		if err != nil {
+			return err
+		}
+		if len(latest) > 0 {
+			settings.LastDigest = latest[0].ID
+		}
+	}
+
+	if err := srv.DB.UpdateStaffSettings(settings); err != nil {
+		return err
+	}
+	srv.notify(r.Context(), "Die Einstellungen wurden gespeichert.")
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+	return nil
+}
+
+type storeLocks struct {
+	html.TemplateData
+	Attempts      []*ordersystem.LoginAttempt
+	Now           time.Time
+	Notifications []string
+}
+
+func (srv *Server) storeLocksGet(w http.ResponseWriter, r *http.Request) error {
+	attempts, err := srv.DB.ReadLoginAttempts()
+	if err != nil {
+		return err
+	}
+	return html.StoreLocks.Execute(w, storeLocks{
+		TemplateData:  srv.storeTemplateData(r),
+		Attempts:      attempts,
+		Now:           time.Now(),
+		Notifications: srv.notifications(r.Context()),
+	})
+}
+
+func (srv *Server) storeLocksUnlockPost(w http.ResponseWriter, r *http.Request) error {
+	var key = r.PostFormValue("key")
+	if err := srv.DB.DeleteLoginAttempt(key); err != nil {
+		return err
+	}
+	srv.notify(r.Context(), "%s wurde entsperrt.", key)
+	http.Redirect(w, r, "/locks", http.StatusSeeOther)
+	return nil
+}
+
+func (srv *Server) clientCollLogoutOthersPost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	if err := srv.logoutOtherClients(r.Context(), coll.ID); err != nil {
+		return err
+	}
+	srv.notify(r.Context(), "Alle anderen Sitzungen wurden abgemeldet.")
+	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
+	return nil
+}
+
+type storeSessions struct {
+	html.TemplateData
+	Sessions      []*ordersystem.LoginSession
+	Current       string
+	Notifications []string
+}
+
+func (srv *Server) storeSessionsGet(w http.ResponseWriter, r *http.Request) error {
+	sessions, err := srv.DB.ReadSessions()
+	if err != nil {
+		return err
+	}
+	return html.StoreSessions.Execute(w, storeSessions{
+		TemplateData:  srv.storeTemplateData(r),
+		Sessions:      sessions,
+		Current:       srv.Sessions.GetString(r.Context(), "sid"),
+		Notifications: srv.notifications(r.Context()),
+	})
+}
+
+// storeSessionsRevokePost removes a session from the index. The session is logged out on its next request.
+func (srv *Server) storeSessionsRevokePost(w http.ResponseWriter, r *http.Request) error {
+	if err := srv.DB.DeleteSession(r.PostFormValue("id")); err != nil {
+		return err
+	}
+	srv.notify(r.Context(), "Die Sitzung wurde beendet.")
+	http.Redirect(w, r, "/sessions", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dys2p/eco/id"
+)
+
+// Matrix sends notifications from a bot account via the client-server API.
+// The direct chat rooms are stored in the "m.direct" account data of the bot, like other clients do, so we don't have to store them.
+// Messages are not end-to-end encrypted, so they must not contain details.
+type Matrix struct {
+	Homeserver  string `json:"homeserver"` // like "https://matrix.example.com"
+	UserID      string `json:"user-id"`    // bot account, like "@bot:example.com"
+	AccessToken string `json:"access-token"`
+}
+
+func LoadMatrix(jsonPath string) (*Matrix, error) {
+	data, err := os.ReadFile(jsonPath)
+	if err != nil {
+		return nil, err
+	}
+	var m = &Matrix{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("unmarshaling json: %w", err)
+	}
+	m.Homeserver = strings.TrimSuffix(m.Homeserver, "/")
+	return m, nil
+}
+
+func (m *Matrix) Send(to string, subject string, body []byte) error {
+	if !strings.HasPrefix(to, "@") || !strings.Contains(to, ":") {
+		return fmt.Errorf("invalid matrix user id: %s", to)
+	}
+	roomID, err := m.directRoom(to)
+	if err != nil {
+		return err
+	}
+	var path = fmt.Sprintf("rooms/%s/send/m.room.message/%s", url.PathEscape(roomID), id.New(16, id.AlphanumCaseSensitiveDigits))
+	return m.do(http.MethodPut, path, map[string]string{
+		"msgtype": "m.text",
+		"body":    string(body),
+	}, nil)
+}
+
+// directRoom returns the direct chat room with the user. If there is none, it is created.
+func (m *Matrix) directRoom(userID string) (string, error) {
+	var direct = make(map[string][]string)
+	var directPath = fmt.Sprintf("user/%s/account_data/m.direct", url.PathEscape(m.UserID))
+	if err := m.do(http.MethodGet, directPath, nil, &direct); err != nil && !errors.Is(err, errMatrixNotFound) {
+		return "", err
+	}
+	if rooms := direct[userID]; len(rooms) > 0 {
+		return rooms[len(rooms)-1], nil
+	}
+
+	var created struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := m.do(http.MethodPost, "createRoom", map[string]any{
+		"invite":    []string{userID},
+		"is_direct": true,
+		"preset":    "trusted_private_chat",
+	}, &created); err != nil {
+		return "", err
+	}
+
+	direct[userID] = append(direct[userID], created.RoomID)
+	if err := m.do(http.MethodPut, directPath, direct, nil); err != nil {
+		return "", err
+	}
+	return created.RoomID, nil
+}
+
+var errMatrixNotFound = errors.New("matrix: not found")
+
+func (m *Matrix) do(method, path string, reqBody, respBody any) error {
+	var body io.Reader
+	if reqBody != nil {
+		data, err := json.Marshal(reqBody)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/_matrix/client/v3/%s", m.Homeserver, path), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+m.AccessToken)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := (&http.Client{
+		Timeout: 10 * time.Second,
+	}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// ok
+	case http.StatusNotFound:
+		return errMatrixNotFound
+	default:
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("matrix: response status %d: %s", resp.StatusCode, data)
+	}
+
+	if respBody == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(respBody)
+}
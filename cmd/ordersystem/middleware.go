@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/dys2p/ordersystem"
 	"github.com/dys2p/ordersystem/html"
@@ -12,18 +14,50 @@ import (
 
 type HandlerErrFunc func(http.ResponseWriter, *http.Request) error
 
-func (srv *Server) auth(f http.HandlerFunc) http.HandlerFunc {
+// auth requires a store login, TOTP enrolment if it is required, and a role which has the given permission. Then it writes an audit entry.
+func (srv *Server) auth(permission string, f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if srv.Sessions.Exists(r.Context(), "username") {
-			f(w, r)
-		} else {
+		if !srv.Sessions.Exists(r.Context(), "username") {
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
 		}
+		if valid, err := srv.sessionValid(r.Context(), ordersystem.StoreSession, srv.sessionUsername(r)); err != nil {
+			srv.storeError(w, r, err.Error())
+			return
+		} else if !valid {
+			srv.logout(r.Context()) // revoked
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		if srv.Sessions.GetBool(r.Context(), "totp-required") && !strings.HasPrefix(r.URL.Path, "/totp") {
+			http.Redirect(w, r, "/totp", http.StatusSeeOther) // enrolment is required before anything else
+			return
+		}
+		if !srv.sessionRole(r).Can(permission) {
+			w.WriteHeader(http.StatusForbidden)
+			srv.storeError(w, r, "Deine Rolle hat keine Berechtigung für diese Aktion.")
+			return
+		}
+		action, target := auditRoute(r)
+		if err := srv.audit(srv.sessionUsername(r), action, target); err != nil {
+			srv.storeError(w, r, err.Error()) // no action without audit entry
+			return
+		}
+		f(w, r)
 	}
 }
 
+// csrfMsg is shown if a POST request lacks the CSRF token of the session, usually because the session has expired in the meantime.
+const csrfMsg = "Das Formular ist abgelaufen oder stammt nicht von dieser Seite. Bitte lade die Seite neu und versuche es noch einmal."
+
+// client verifies the CSRF token of POST requests.
 func (srv *Server) client(f HandlerErrFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !srv.csrfValid(r) {
+			w.WriteHeader(http.StatusForbidden)
+			srv.clientError(w, r, csrfMsg)
+			return
+		}
 		if err := f(w, r); err != nil {
 			var msg string
 			if err == ErrNotFound {
@@ -31,20 +65,24 @@ func (srv *Server) client(f HandlerErrFunc) http.HandlerFunc {
 			} else {
 				msg = fmt.Sprintf("Interner Fehler: %s", err.Error())
 			}
-			if err := html.ClientError.Execute(w, struct {
-				html.TemplateData
-				Msg string
-			}{
-				TemplateData: srv.MakeTemplateData(r),
-				Msg:          msg,
-			}); err != nil {
-				log.Printf("error executing error template: %v", err)
-			}
+			srv.clientError(w, r, msg)
 		}
 	}
 }
 
-// requires authentication
+func (srv *Server) clientError(w http.ResponseWriter, r *http.Request, msg string) {
+	if err := html.ClientError.Execute(w, struct {
+		html.TemplateData
+		Msg string
+	}{
+		TemplateData: srv.MakeTemplateData(r),
+		Msg:          msg,
+	}); err != nil {
+		log.Printf("error executing error template: %v", err)
+	}
+}
+
+// requires authentication, makes the collection the current one
 func (srv *Server) clientWithCollection(f func(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error) http.HandlerFunc {
 	return srv.client(
 		func(w http.ResponseWriter, r *http.Request) error {
@@ -52,28 +90,53 @@ func (srv *Server) clientWithCollection(f func(w http.ResponseWriter, r *http.Re
 			if len(collID) > 10 {
 				collID = collID[:10]
 			}
-			if srv.Sessions.GetString(r.Context(), "coll-id") != collID {
-				return ErrNotFound // not logged in, or into another collection
+			if !slices.Contains(srv.sessionCollIDs(r.Context()), collID) {
+				return ErrNotFound // not logged in into this collection
 			}
 			var coll, err = srv.DB.ReadColl(collID)
 			if err != nil {
 				return err
 			}
+			if valid, err := srv.sessionValid(r.Context(), ordersystem.ClientSession, coll.ID); err != nil {
+				return err
+			} else if !valid {
+				srv.removeColl(r.Context(), coll.ID) // revoked
+				return ErrNotFound
+			}
+			srv.setCurrentColl(r.Context(), coll.ID)
 			return f(w, r, coll)
 		},
 	)
 }
 
-func store(f HandlerErrFunc) http.HandlerFunc {
+// store verifies the CSRF token of POST requests.
+func (srv *Server) store(f HandlerErrFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !srv.csrfValid(r) {
+			w.WriteHeader(http.StatusForbidden)
+			srv.storeError(w, r, csrfMsg)
+			return
+		}
 		if err := f(w, r); err != nil {
-			html.StoreError.Execute(w, err.Error())
+			srv.storeError(w, r, err.Error())
 		}
 	}
 }
 
+func (srv *Server) storeError(w http.ResponseWriter, r *http.Request, msg string) {
+	if err := html.StoreError.Execute(w, struct {
+		html.TemplateData
+		Msg string
+	}{
+		TemplateData: srv.storeTemplateData(r),
+		Msg:          msg,
+	}); err != nil {
+		log.Printf("error executing error template: %v", err)
+	}
+}
+
 func (srv *Server) storeWithCollection(f func(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error) http.HandlerFunc {
-	return store(
+	return srv.store(
 		func(w http.ResponseWriter, r *http.Request) error {
 			var collID = httprouter.ParamsFromContext(r.Context()).ByName("collid")
 			if len(collID) > 10 {
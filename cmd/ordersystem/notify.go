@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dys2p/ordersystem"
+	"github.com/dys2p/ordersystem/html"
+)
+
+// Notifier sends a message to a contact address. It is implemented by the eco/email package, XMPP and Matrix.
+type Notifier interface {
+	Send(to string, subject string, body []byte) error
+}
+
+type notificationData struct {
+	CollID  string
+	State   ordersystem.CollState // latest state change, if any
+	Message bool
+	Link    string
+}
+
+// enqueuePendingNotifications schedules sending for all collections with pending notifications, in case their job has been lost or has failed finally.
+func (srv *Server) enqueuePendingNotifications() error {
+	collIDs, err := srv.DB.ReadPendingNotificationColls()
+	if err != nil {
+		return fmt.Errorf("reading pending notifications: %w", err)
+	}
+	for _, collID := range collIDs {
+		if err := srv.DB.CreateJob(ordersystem.JobNotify, collID, time.Now()); err != nil {
+			return fmt.Errorf("scheduling notifications of %s: %w", collID, err)
+		}
+	}
+	return nil
+}
+
+// SendNotifications sends all pending notifications of a collection in one message, using the contact protocol of the client.
+// The message contains the collection ID and state only, so the client must log in to read messages.
+func (srv *Server) SendNotifications(collID string) error {
+	notifications, err := srv.DB.ReadNotifications(collID)
+	if err != nil {
+		return err
+	}
+	var pending []*ordersystem.Notification
+	for _, n := range notifications {
+		if n.Status == ordersystem.NotificationPending {
+			pending = append(pending, n)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	coll, err := srv.DB.ReadColl(collID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil // deleted in the meantime, along with its notifications
+	}
+	if err != nil {
+		return err
+	}
+
+	var status = ordersystem.NotificationSent
+	var sendErr error
+	if notifier, ok := srv.Notifiers[coll.ClientContactProtocol]; ok && coll.WantsNotifications() {
+		sendErr = srv.sendNotification(notifier, coll, pending)
+	} else {
+		status = ordersystem.NotificationSkipped
+	}
+
+	for _, n := range pending {
+		if err := srv.DB.UpdateNotification(n, status, sendErr); err != nil {
+			return err
+		}
+	}
+	return sendErr
+}
+
+func (srv *Server) sendNotification(notifier Notifier, coll *ordersystem.Collection, pending []*ordersystem.Notification) error {
+	var data = notificationData{
+		CollID: coll.ID,
+	}
+	if srv.DB.Config.ClientURL != "" {
+		data.Link = srv.DB.Config.ClientURL + coll.Link()
+	}
+	for _, n := range pending {
+		switch n.Kind {
+		case ordersystem.NotifyMessage:
+			data.Message = true
+		case ordersystem.NotifyState:
+			data.State = n.State
+		}
+	}
+
+	var body = &bytes.Buffer{}
+	if err := html.Notification.Execute(body, data); err != nil {
+		return err
+	}
+	return notifier.Send(coll.ClientContact, "Neuigkeiten zu deinem Bestellauftrag", body.Bytes())
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
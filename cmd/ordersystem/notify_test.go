@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dys2p/eco/email"
+	"github.com/dys2p/ordersystem"
+)
+
+// smtpCert is the certificate of the SMTP stand-in. The e-mail package verifies it against the system roots, so TestMain adds it there before any TLS connection is made.
+var smtpCert tls.Certificate
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "ordersystem-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	smtpCert, err = selfSignedCert(filepath.Join(dir, "cert.pem"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("SSL_CERT_FILE", filepath.Join(dir, "cert.pem"))
+	var code = m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// selfSignedCert creates a certificate for 127.0.0.1 and writes it to certPath.
+func selfSignedCert(certPath string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var template = &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// xmppStandIn accepts one connection and plays a server without TLS which offers SASL PLAIN and resource binding. It returns its address and a channel which receives the message or an error.
+func xmppStandIn(t *testing.T, password string) (string, <-chan any) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var result = make(chan any, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close()
+		msg, err := xmppServe(conn, password)
+		if err != nil {
+			result <- err
+			return
+		}
+		result <- msg
+	}()
+	return listener.Addr().String(), result
+}
+
+func xmppServe(conn net.Conn, password string) (*xmppMessage, error) {
+	const header = "<?xml version='1.0'?><stream:stream from='example.com' id='1' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>"
+
+	// first stream, authentication
+
+	var dec = xml.NewDecoder(conn)
+	if err := xmppStandInExpect(dec, "stream"); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(conn, header+"<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>"); err != nil {
+		return nil, err
+	}
+	start, err := xmppNext(dec)
+	if err != nil {
+		return nil, err
+	}
+	var auth struct {
+		Mechanism   string `xml:"mechanism,attr"`
+		Credentials string `xml:",chardata"`
+	}
+	if err := dec.DecodeElement(&auth, &start); err != nil {
+		return nil, err
+	}
+	credentials, err := base64.StdEncoding.DecodeString(auth.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	if start.Name.Local != "auth" || auth.Mechanism != "PLAIN" || string(credentials) != "\x00bot\x00"+password {
+		io.WriteString(conn, "<failure xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><not-authorized/></failure>")
+		return nil, fmt.Errorf("authentication failed: %s %q", auth.Mechanism, credentials)
+	}
+	if _, err := io.WriteString(conn, "<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>"); err != nil {
+		return nil, err
+	}
+
+	// second stream, binding and message
+
+	dec = xml.NewDecoder(conn)
+	if err := xmppStandInExpect(dec, "stream"); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(conn, header+"<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>"); err != nil {
+		return nil, err
+	}
+	if err := xmppStandInExpect(dec, "iq"); err != nil {
+		return nil, err
+	}
+	if err := dec.Skip(); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(conn, "<iq type='result' id='bind'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>bot@example.com/1</jid></bind></iq>"); err != nil {
+		return nil, err
+	}
+	start, err = xmppNext(dec)
+	if err != nil {
+		return nil, err
+	}
+	var msg = &xmppMessage{}
+	if err := dec.DecodeElement(msg, &start); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func xmppStandInExpect(dec *xml.Decoder, name string) error {
+	start, err := xmppNext(dec)
+	if err != nil {
+		return err
+	}
+	if start.Name.Local != name {
+		return fmt.Errorf("expected %s, got %s", name, start.Name.Local)
+	}
+	return nil
+}
+
+func TestXMPPSend(t *testing.T) {
+	addr, result := xmppStandIn(t, "secret")
+	var x = &XMPP{JID: "bot@example.com", Password: "secret", Host: addr, NoTLS: true}
+	if err := x.Send("client@example.org", "subject", []byte("Auftrag ABCDEF: angenommen")); err != nil {
+		t.Fatal(err)
+	}
+	switch r := (<-result).(type) {
+	case error:
+		t.Fatal(r)
+	case *xmppMessage:
+		if r.To != "client@example.org" || r.Type != "chat" || r.Body != "Auftrag ABCDEF: angenommen" {
+			t.Errorf("got message %+v", r)
+		}
+	}
+}
+
+func TestXMPPSendWrongPassword(t *testing.T) {
+	addr, result := xmppStandIn(t, "secret")
+	var x = &XMPP{JID: "bot@example.com", Password: "wrong", Host: addr, NoTLS: true}
+	if err := x.Send("client@example.org", "subject", []byte("body")); err == nil {
+		t.Error("expected error")
+	}
+	<-result
+}
+
+func TestXMPPSendRequiresTLS(t *testing.T) {
+	addr, result := xmppStandIn(t, "secret")
+	var x = &XMPP{JID: "bot@example.com", Password: "secret", Host: addr}
+	if err := x.Send("client@example.org", "subject", []byte("body")); err == nil || !strings.Contains(err.Error(), "starttls") {
+		t.Errorf("got %v, want starttls error", err)
+	}
+	<-result // the stand-in fails when the client hangs up
+}
+
+// matrixStandIn is a homeserver which supports the endpoints used by Matrix.
+type matrixStandIn struct {
+	sync.Mutex
+	Direct   map[string][]string // m.direct account data of the bot, nil if not set
+	Rooms    int
+	Messages map[string][]string // key: room ID
+}
+
+func (s *matrixStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var path = strings.TrimPrefix(r.URL.Path, "/_matrix/client/v3/")
+	switch {
+	case r.Method == http.MethodGet && path == "user/@bot:example.com/account_data/m.direct":
+		if s.Direct == nil {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"errcode":"M_NOT_FOUND"}`)
+			return
+		}
+		json.NewEncoder(w).Encode(s.Direct)
+	case r.Method == http.MethodPut && path == "user/@bot:example.com/account_data/m.direct":
+		json.NewDecoder(r.Body).Decode(&s.Direct)
+		io.WriteString(w, "{}")
+	case r.Method == http.MethodPost && path == "createRoom":
+		s.Rooms++
+		fmt.Fprintf(w, `{"room_id":"!room%d:example.com"}`, s.Rooms)
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "rooms/"):
+		roomID, _, _ := strings.Cut(strings.TrimPrefix(path, "rooms/"), "/send/m.room.message/")
+		var content struct {
+			Body string `json:"body"`
+		}
+		json.NewDecoder(r.Body).Decode(&content)
+		s.Messages[roomID] = append(s.Messages[roomID], content.Body)
+		io.WriteString(w, `{"event_id":"$1"}`)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestMatrixSend(t *testing.T) {
+	var standIn = &matrixStandIn{Messages: make(map[string][]string)}
+	var server = httptest.NewServer(standIn)
+	defer server.Close()
+
+	var m = &Matrix{Homeserver: server.URL, UserID: "@bot:example.com", AccessToken: "token"}
+	for _, body := range []string{"first", "second"} {
+		if err := m.Send("@client:example.org", "subject", []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Send("@other:example.org", "subject", []byte("third")); err != nil {
+		t.Fatal(err)
+	}
+
+	if standIn.Rooms != 2 {
+		t.Errorf("got %d rooms, want 2", standIn.Rooms)
+	}
+	if got := standIn.Direct["@client:example.org"]; len(got) != 1 || got[0] != "!room1:example.com" {
+		t.Errorf("got direct rooms %v", got)
+	}
+	if got := strings.Join(standIn.Messages["!room1:example.com"], ","); got != "first,second" {
+		t.Errorf("got messages %s, want first,second", got)
+	}
+	if got := strings.Join(standIn.Messages["!room2:example.com"], ","); got != "third" {
+		t.Errorf("got messages %s, want third", got)
+	}
+}
+
+func TestMatrixSendUnauthorized(t *testing.T) {
+	var server = httptest.NewServer(&matrixStandIn{Messages: make(map[string][]string)})
+	defer server.Close()
+
+	var m = &Matrix{Homeserver: server.URL, UserID: "@bot:example.com", AccessToken: "wrong"}
+	if err := m.Send("@client:example.org", "subject", []byte("body")); err == nil {
+		t.Error("expected error")
+	}
+}
+
+// smtpStandIn is a mail server with implicit TLS and AUTH PLAIN which records the received mails.
+type smtpStandIn struct {
+	sync.Mutex
+	Password string
+	Mails    []string
+}
+
+// listen starts the stand-in and returns its address.
+func (s *smtpStandIn) listen(t *testing.T) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{smtpCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	var r = bufio.NewReader(conn)
+	io.WriteString(conn, "220 localhost\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		var command, arg, _ = strings.Cut(strings.TrimSpace(line), " ")
+		switch strings.ToUpper(command) {
+		case "EHLO", "HELO":
+			io.WriteString(conn, "250-localhost\r\n250 AUTH PLAIN\r\n")
+		case "AUTH":
+			credentials, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			if string(credentials) != "\x00bot@example.com\x00"+s.Password {
+				io.WriteString(conn, "535 authentication failed\r\n")
+				continue
+			}
+			io.WriteString(conn, "235 ok\r\n")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			io.WriteString(conn, "250 ok\r\n")
+		case "DATA":
+			io.WriteString(conn, "354 go ahead\r\n")
+			var mail strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				mail.WriteString(line)
+			}
+			s.Lock()
+			s.Mails = append(s.Mails, mail.String())
+			s.Unlock()
+			io.WriteString(conn, "250 ok\r\n")
+		case "QUIT":
+			io.WriteString(conn, "221 bye\r\n")
+			return
+		default:
+			io.WriteString(conn, "502 not implemented\r\n")
+		}
+	}
+}
+
+// createNotifiedColl creates a collection with an e-mail contact and a pending notification about a store message.
+func createNotifiedColl(t *testing.T, srv *Server, collID string) *ordersystem.Collection {
+	var coll = &ordersystem.Collection{ID: collID}
+	if err := srv.DB.CreateCollection(coll); err != nil {
+		t.Fatal(err)
+	}
+	coll.ClientContact = "client@example.org"
+	coll.ClientContactProtocol = "email"
+	if err := srv.DB.UpdateCollAndTasks(coll); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.DB.CreateEvent(ordersystem.Store, coll, 0, "Geheime Nachricht"); err != nil {
+		t.Fatal(err)
+	}
+	return coll
+}
+
+func notificationStatus(t *testing.T, srv *Server, collID string) ordersystem.NotificationStatus {
+	notifications, err := srv.DB.ReadNotifications(collID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notifications) != 1 {
+		t.Fatalf("got %d notifications, want 1", len(notifications))
+	}
+	return notifications[0].Status
+}
+
+func TestEmailSend(t *testing.T) {
+	srv, _, _ := newReconcileServer(t)
+	var standIn = &smtpStandIn{Password: "secret"}
+	srv.Notifiers = map[string]Notifier{"email": email.SMTP{From: "bot@example.com", Username: "bot@example.com", Password: "secret", Host: standIn.listen(t)}}
+	srv.DB.Config.ClientURL = "https://order.example.com"
+
+	createNotifiedColl(t, srv, "AAAAAA")
+	if err := srv.SendNotifications("AAAAAA"); err != nil {
+		t.Fatal(err)
+	}
+	if status := notificationStatus(t, srv, "AAAAAA"); status != ordersystem.NotificationSent {
+		t.Errorf("got status %s, want %s", status, ordersystem.NotificationSent)
+	}
+	if len(standIn.Mails) != 1 {
+		t.Fatalf("got %d mails, want 1", len(standIn.Mails))
+	}
+	var mail = standIn.Mails[0]
+	if !strings.Contains(mail, "To: client@example.org") || !strings.Contains(mail, "AAAAAA") || !strings.Contains(mail, "https://order.example.com/collection/AAAAAA") {
+		t.Errorf("mail lacks recipient, ID or link:\n%s", mail)
+	}
+	if strings.Contains(mail, "Geheime Nachricht") {
+		t.Errorf("mail contains the message text:\n%s", mail)
+	}
+
+	// nothing is pending any more
+	if err := srv.SendNotifications("AAAAAA"); err != nil {
+		t.Fatal(err)
+	}
+	if len(standIn.Mails) != 1 {
+		t.Errorf("got %d mails, want 1", len(standIn.Mails))
+	}
+}
+
+func TestEmailSendOptedOut(t *testing.T) {
+	srv, _, _ := newReconcileServer(t)
+	var standIn = &smtpStandIn{Password: "secret"}
+	srv.Notifiers = map[string]Notifier{"email": email.SMTP{From: "bot@example.com", Username: "bot@example.com", Password: "secret", Host: standIn.listen(t)}}
+
+	var coll = createNotifiedColl(t, srv, "AAAAAA")
+	coll.NotificationsOptOut = true
+	if err := srv.DB.UpdateCollAndTasks(coll); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SendNotifications("AAAAAA"); err != nil {
+		t.Fatal(err)
+	}
+	if status := notificationStatus(t, srv, "AAAAAA"); status != ordersystem.NotificationSkipped {
+		t.Errorf("got status %s, want %s", status, ordersystem.NotificationSkipped)
+	}
+	if len(standIn.Mails) != 0 {
+		t.Errorf("got %d mails, want 0", len(standIn.Mails))
+	}
+}
+
+func TestEmailSendFailed(t *testing.T) {
+	srv, _, _ := newReconcileServer(t)
+	var standIn = &smtpStandIn{Password: "secret"}
+	var addr = standIn.listen(t)
+	srv.Notifiers = map[string]Notifier{"email": email.SMTP{From: "bot@example.com", Username: "bot@example.com", Password: "wrong", Host: addr}}
+
+	createNotifiedColl(t, srv, "AAAAAA")
+	if err := srv.SendNotifications("AAAAAA"); err == nil {
+		t.Error("expected error")
+	}
+	if status := notificationStatus(t, srv, "AAAAAA"); status != ordersystem.NotificationPending {
+		t.Errorf("got status %s, want %s", status, ordersystem.NotificationPending)
+	}
+
+	// the retry succeeds
+	srv.Notifiers["email"] = email.SMTP{From: "bot@example.com", Username: "bot@example.com", Password: "secret", Host: addr}
+	if err := srv.SendNotifications("AAAAAA"); err != nil {
+		t.Fatal(err)
+	}
+	if status := notificationStatus(t, srv, "AAAAAA"); status != ordersystem.NotificationSent {
+		t.Errorf("got status %s, want %s", status, ordersystem.NotificationSent)
+	}
+	if len(standIn.Mails) != 1 {
+		t.Errorf("got %d mails, want 1", len(standIn.Mails))
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dys2p/eco/captcha"
+	"github.com/dys2p/eco/diceware"
+	"github.com/dys2p/ordersystem"
+	"github.com/dys2p/ordersystem/html"
+)
+
+type clientPassphrase struct {
+	html.TemplateData
+	*ordersystem.Collection
+	OldPassErr          bool
+	CollPass            string // new passphrase
+	CollPassErr         bool
+	CheckWrittenDown    bool
+	CheckWrittenDownErr bool
+	LockedUntil         string
+}
+
+func (srv *Server) clientCollPassphraseGet(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	collPass, err := diceware.Length(5, diceware.German)
+	if err != nil {
+		return err
+	}
+	return html.ClientCollPassphrase.Execute(w, clientPassphrase{
+		TemplateData: srv.MakeTemplateData(r),
+		Collection:   coll,
+		CollPass:     collPass,
+	})
+}
+
+// clientCollPassphrasePost changes the passphrase. It requires the current passphrase, so a stolen session can't take over the collection.
+func (srv *Server) clientCollPassphrasePost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	var data = clientPassphrase{
+		TemplateData:     srv.MakeTemplateData(r),
+		Collection:       coll,
+		CollPass:         strings.TrimSpace(r.PostFormValue("collection-passphrase")),
+		CheckWrittenDown: r.PostFormValue("check-written-down") != "",
+	}
+	data.CollPassErr = data.CollPass == ""
+	data.CheckWrittenDownErr = !data.CheckWrittenDown
+	if data.CollPassErr || data.CheckWrittenDownErr {
+		return html.ClientCollPassphrase.Execute(w, data)
+	}
+
+	guard, err := srv.guardLogin(r, ordersystem.CollLoginKey(coll.ID))
+	if err != nil {
+		return err
+	}
+	if guard.locked() {
+		data.LockedUntil = guard.LockedUntil.Format("15:04")
+		return html.ClientCollPassphrase.Execute(w, data)
+	}
+	if !coll.CompareHash(strings.TrimSpace(r.PostFormValue("old-passphrase"))) {
+		data.OldPassErr = true
+		if _, err := srv.loginFailed(guard); err != nil {
+			return err
+		}
+		return html.ClientCollPassphrase.Execute(w, data)
+	}
+
+	if err := coll.SetPass(data.CollPass); err != nil {
+		return err
+	}
+	if err := srv.DB.UpdateCollPass(ordersystem.Client, coll, "Die Passphrase wurde geändert."); err != nil {
+		return err
+	}
+	if err := srv.logoutOtherClients(r.Context(), coll.ID); err != nil {
+		return err
+	}
+	srv.notify(r.Context(), "Deine Passphrase wurde geändert. Andere Sitzungen wurden abgemeldet.")
+	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
+	return nil
+}
+
+type clientReset struct {
+	html.TemplateData
+	CollID              string
+	CollIDErr           bool
+	CodeErr             bool
+	CollPass            string // new passphrase
+	CollPassErr         bool
+	CheckWrittenDown    bool
+	CheckWrittenDownErr bool
+	Captcha             captcha.TemplateData // if required after failed attempts
+	LockedUntil         string
+}
+
+func (srv *Server) clientResetGet(w http.ResponseWriter, r *http.Request) error {
+	collPass, err := diceware.Length(5, diceware.German)
+	if err != nil {
+		return err
+	}
+	return html.ClientReset.Execute(w, clientReset{
+		TemplateData: srv.MakeTemplateData(r),
+		CollPass:     collPass,
+	})
+}
+
+// clientResetPost sets a new passphrase with a reset code from the store. Failed attempts count like failed logins.
+func (srv *Server) clientResetPost(w http.ResponseWriter, r *http.Request) error {
+	var data = clientReset{
+		TemplateData:     srv.MakeTemplateData(r),
+		CollID:           strings.TrimSpace(r.PostFormValue("collection-id")),
+		CollPass:         strings.TrimSpace(r.PostFormValue("collection-passphrase")),
+		CheckWrittenDown: r.PostFormValue("check-written-down") != "",
+	}
+	data.CollIDErr = !isID(data.CollID)
+	data.CollPassErr = data.CollPass == ""
+	data.CheckWrittenDownErr = !data.CheckWrittenDown
+	if data.CollIDErr || data.CollPassErr || data.CheckWrittenDownErr {
+		return html.ClientReset.Execute(w, data)
+	}
+
+	guard, err := srv.guardLogin(r, ordersystem.CollLoginKey(data.CollID))
+	if err != nil {
+		return err
+	}
+	if guard.locked() {
+		data.LockedUntil = guard.LockedUntil.Format("15:04")
+		return html.ClientReset.Execute(w, data)
+	}
+	if !guard.verifyCaptcha(r) {
+		data.Captcha = captcha.TemplateData{
+			ID:  captcha.New(), // old captcha has been deleted during verification
+			Err: true,
+		}
+		return html.ClientReset.Execute(w, data)
+	}
+
+	coll, err := srv.DB.ReadColl(data.CollID)
+	if err != nil || !coll.CheckResetCode(r.PostFormValue("reset-code"), time.Now()) {
+		data.CodeErr = true
+		data.Captcha, err = srv.loginFailed(guard)
+		if err != nil {
+			return err
+		}
+		return html.ClientReset.Execute(w, data)
+	}
+
+	if err := coll.SetPass(data.CollPass); err != nil {
+		return err
+	}
+	if err := srv.DB.UpdateCollPass(ordersystem.Client, coll, "Die Passphrase wurde mit einem Reset-Code neu gesetzt."); err != nil {
+		return err
+	}
+	if err := srv.loginSucceeded(guard); err != nil {
+		return err
+	}
+	if err := srv.loginClient(r.Context(), coll.ID); err != nil {
+		return err
+	}
+	if err := srv.logoutOtherClients(r.Context(), coll.ID); err != nil {
+		return err
+	}
+	srv.notify(r.Context(), "Deine neue Passphrase ist gesetzt. Andere Sitzungen wurden abgemeldet.")
+	http.Redirect(w, r, coll.Link(), http.StatusSeeOther)
+	return nil
+}
+
+// storeCollResetCodePost issues a reset code and shows it once. The staff must pass it to the client through a trusted channel.
+func (srv *Server) storeCollResetCodePost(w http.ResponseWriter, r *http.Request, coll *ordersystem.Collection) error {
+	code, err := coll.NewResetCode(time.Now())
+	if err != nil {
+		return err
+	}
+	var expires = time.Unix(coll.ResetCodeExpires, 0).Format("02.01.2006 15:04")
+	if err := srv.DB.UpdateCollPass(ordersystem.Store, coll, "Ein Code zum Zurücksetzen der Passphrase wurde erstellt. Er ist bis "+expires+" Uhr gültig."); err != nil {
+		return err
+	}
+	return html.StoreCollResetCode.Execute(w, struct {
+		html.TemplateData
+		*ordersystem.Collection
+		Code    string
+		Expires string
+	}{
+		TemplateData: srv.storeTemplateData(r),
+		Collection:   coll,
+		Code:         code,
+		Expires:      expires,
+	})
+}
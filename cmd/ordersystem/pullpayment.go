@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dys2p/btcpay"
+	"github.com/dys2p/eco/id"
+)
+
+// PullPayments creates BTCPay pull payments. A pull payment is a refund link which the client can claim with a crypto address of their choice.
+// The btcpay package does not support them yet.
+type PullPayments interface {
+	CreatePullPayment(name string, cents int) (*PullPayment, error)
+	GetPayouts(pullPaymentID string) ([]Payout, error)
+	GetPullPayment(pullPaymentID string) (*PullPayment, error)
+}
+
+type PullPayment struct {
+	ID       string `json:"id"`
+	Archived bool   `json:"archived"` // no more claims are possible
+	ViewLink string `json:"viewLink"` // claim link for the client
+}
+
+const PayoutCompleted = "Completed"
+
+type Payout struct {
+	ID     string `json:"id"`
+	Amount string `json:"amount"` // in the currency of the pull payment, example: "12.34"
+	State  string `json:"state"`  // AwaitingApproval, AwaitingPayment, InProgress, Completed or Cancelled
+}
+
+// Cents parses the payout amount, which is in euro.
+func (payout Payout) Cents() (int, error) {
+	amount, err := strconv.ParseFloat(payout.Amount, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int(math.Round(amount * 100.0)), nil
+}
+
+// ServerPullPayments uses the Greenfield API of the BTCPay server. The user API key requires the permissions btcpay.store.cancreatepullpayments and btcpay.store.canviewpullpayments.
+type ServerPullPayments struct {
+	*btcpay.ServerStore
+}
+
+func (s ServerPullPayments) doRequest(method string, path string, body io.Reader) ([]byte, error) {
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/api/v1/%s", s.Host, path), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", s.UserAPIKey))
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := (&http.Client{
+		Timeout: 10 * time.Second,
+	}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// ok
+	case http.StatusUnauthorized: // 401, "Unauthorized" should be "Unauthenticated"
+		return nil, btcpay.ErrUnauthenticated
+	case http.StatusForbidden:
+		return nil, btcpay.ErrUnauthorized
+	case http.StatusBadRequest:
+		return nil, btcpay.ErrBadRequest
+	case http.StatusNotFound:
+		return nil, btcpay.ErrNotFound
+	default:
+		return nil, fmt.Errorf("response status: %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func (s ServerPullPayments) CreatePullPayment(name string, cents int) (*PullPayment, error) {
+
+	payload, err := json.Marshal(struct {
+		Name              string `json:"name"`
+		Amount            string `json:"amount"`
+		Currency          string `json:"currency"`
+		AutoApproveClaims bool   `json:"autoApproveClaims"`
+	}{
+		Name:              name,
+		Amount:            fmt.Sprintf("%.2f", float64(cents)/100.0),
+		Currency:          "EUR",
+		AutoApproveClaims: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := s.doRequest(http.MethodPost, fmt.Sprintf("stores/%s/pull-payments", s.ID), bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	var pullPayment = &PullPayment{}
+	return pullPayment, json.Unmarshal(body, pullPayment)
+}
+
+func (s ServerPullPayments) GetPayouts(pullPaymentID string) ([]Payout, error) {
+
+	body, err := s.doRequest(http.MethodGet, fmt.Sprintf("pull-payments/%s/payouts", pullPaymentID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var payouts = []Payout{}
+	return payouts, json.Unmarshal(body, &payouts)
+}
+
+func (s ServerPullPayments) GetPullPayment(pullPaymentID string) (*PullPayment, error) {
+
+	body, err := s.doRequest(http.MethodGet, fmt.Sprintf("pull-payments/%s", pullPaymentID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var pullPayment = &PullPayment{}
+	return pullPayment, json.Unmarshal(body, pullPayment)
+}
+
+// DummyPullPayments is designed for testing only. It is not thread-safe.
+type DummyPullPayments struct {
+	Archived map[string]bool
+	Payouts  map[string][]Payout
+}
+
+func NewDummyPullPayments() *DummyPullPayments {
+	return &DummyPullPayments{
+		Archived: make(map[string]bool),
+		Payouts:  make(map[string][]Payout),
+	}
+}
+
+func (d *DummyPullPayments) CreatePullPayment(name string, cents int) (*PullPayment, error) {
+	if cents <= 0 {
+		return nil, errors.New("amount must be positive")
+	}
+	var pullPaymentID = id.New(20, id.AlphanumCaseSensitiveDigits)
+	d.Payouts[pullPaymentID] = nil
+	return &PullPayment{
+		ID:       pullPaymentID,
+		ViewLink: "http://example.com/pull-payments/" + pullPaymentID,
+	}, nil
+}
+
+func (d *DummyPullPayments) GetPayouts(pullPaymentID string) ([]Payout, error) {
+	payouts, ok := d.Payouts[pullPaymentID]
+	if !ok {
+		return nil, btcpay.ErrNotFound
+	}
+	return payouts, nil
+}
+
+func (d *DummyPullPayments) GetPullPayment(pullPaymentID string) (*PullPayment, error) {
+	if _, ok := d.Payouts[pullPaymentID]; !ok {
+		return nil, btcpay.ErrNotFound
+	}
+	return &PullPayment{
+		ID:       pullPaymentID,
+		Archived: d.Archived[pullPaymentID],
+		ViewLink: "http://example.com/pull-payments/" + pullPaymentID,
+	}, nil
+}
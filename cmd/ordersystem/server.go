@@ -1,6 +1,8 @@
 package main
 
 import (
+	"sync"
+
 	"github.com/alexedwards/scs/v2"
 	"github.com/dys2p/bitpay"
 	"github.com/dys2p/btcpay"
@@ -13,7 +15,12 @@ type Server struct {
 	BitpayClient *bitpay.Client
 	BtcPayStore  btcpay.Store
 	DB           *ordersystem.DB
+	Notifiers    map[string]Notifier // key: ClientContactProtocol
 	Langs        lang.Languages
+	PullPayments PullPayments
 	Sessions     *scs.SessionManager
 	Users        userdb.Authenticator
+
+	jobWake      chan struct{}
+	paymentMutex sync.Mutex // webhooks and the bot must not book a payment concurrently
 }
@@ -2,15 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"time"
 
 	"github.com/alexedwards/scs/sqlite3store"
 	"github.com/alexedwards/scs/v2"
+	"github.com/dys2p/eco/id"
+	"github.com/dys2p/ordersystem"
 )
 
 func initSessionManager() (*scs.SessionManager, error) {
@@ -30,7 +36,7 @@ func initSessionManager() (*scs.SessionManager, error) {
 	var sessionManager = scs.New()
 	sessionManager.Cookie.Path = "/"
 	sessionManager.Cookie.Persist = false
-	sessionManager.Cookie.SameSite = http.SameSiteLaxMode // prevent CSRF
+	sessionManager.Cookie.SameSite = http.SameSiteLaxMode // prevent CSRF, in addition to the CSRF tokens
 	sessionManager.Cookie.Secure = false
 	sessionManager.IdleTimeout = 3 * 24 * time.Hour
 	sessionManager.Lifetime = 60 * 24 * time.Hour // "absolute expiry which is set when the session is first created and does not change"
@@ -38,18 +44,164 @@ func initSessionManager() (*scs.SessionManager, error) {
 	return sessionManager, nil
 }
 
-func (srv *Server) loginClient(ctx context.Context, collID string) {
-	srv.Sessions.Put(ctx, "coll-id", collID) // "any existing value for the key will be replaced"
+// loginClient adds the collection to the authorized collections of the session and makes it the current one.
+// The session token is renewed, so a token which has been planted before the login can't be used.
+func (srv *Server) loginClient(ctx context.Context, collID string) error {
+	if err := srv.Sessions.RenewToken(ctx); err != nil {
+		return err
+	}
+	if err := srv.indexSession(ctx, ordersystem.ClientSession, collID); err != nil {
+		return err
+	}
+	srv.setCurrentColl(ctx, collID)
+	return nil
+}
+
+// sessionCollIDs returns the authorized collections of the session. The current one is the last.
+func (srv *Server) sessionCollIDs(ctx context.Context) []string {
+	ids, _ := srv.Sessions.Get(ctx, "coll-ids").([]string)
+	return ids
+}
+
+// setCurrentColl moves the collection to the end of the authorized collections, adding it if necessary.
+func (srv *Server) setCurrentColl(ctx context.Context, collID string) {
+	var ids = srv.sessionCollIDs(ctx)
+	if len(ids) > 0 && ids[len(ids)-1] == collID {
+		return // don't modify the session on each request
+	}
+	ids = slices.DeleteFunc(slices.Clone(ids), func(id string) bool { return id == collID })
+	srv.Sessions.Put(ctx, "coll-ids", append(ids, collID))
+}
+
+// removeColl removes the collection from the authorized collections of the session, e.g. because it has been revoked.
+func (srv *Server) removeColl(ctx context.Context, collID string) {
+	var ids = slices.DeleteFunc(slices.Clone(srv.sessionCollIDs(ctx)), func(id string) bool { return id == collID })
+	srv.Sessions.Put(ctx, "coll-ids", ids)
+	srv.Sessions.Remove(ctx, sidKey(ordersystem.ClientSession, collID))
+}
+
+// logoutClient removes the collection from the session and the index. The session stays logged in to its other collections.
+func (srv *Server) logoutClient(ctx context.Context, collID string) error {
+	if sid := srv.Sessions.GetString(ctx, sidKey(ordersystem.ClientSession, collID)); sid != "" {
+		if err := srv.DB.DeleteSession(sid); err != nil {
+			return err
+		}
+	}
+	srv.removeColl(ctx, collID)
+	return nil
 }
 
-func (srv *Server) loginStore(ctx context.Context, username string) {
+// logoutOtherClients revokes all client sessions of the collection except the current one.
+func (srv *Server) logoutOtherClients(ctx context.Context, collID string) error {
+	return srv.DB.DeleteOtherSessions(ordersystem.ClientSession, collID, srv.Sessions.GetString(ctx, sidKey(ordersystem.ClientSession, collID)))
+}
+
+// loginStore logs the session in as the store user. Like loginClient, it renews the session token.
+func (srv *Server) loginStore(ctx context.Context, username string) error {
+	if err := srv.Sessions.RenewToken(ctx); err != nil {
+		return err
+	}
+	if err := srv.indexSession(ctx, ordersystem.StoreSession, username); err != nil {
+		return err
+	}
 	srv.Sessions.Put(ctx, "username", username)
+	return nil
+}
+
+// sidKey returns the session key of the index ID. A client session has one index entry for each authorized collection.
+func sidKey(kind ordersystem.SessionKind, subject string) string {
+	if kind == ordersystem.ClientSession {
+		return "coll-sid:" + subject
+	}
+	return "sid"
+}
+
+// indexSession adds the session to the session index with a new ID. A previous index entry of the session and subject is removed.
+func (srv *Server) indexSession(ctx context.Context, kind ordersystem.SessionKind, subject string) error {
+	var key = sidKey(kind, subject)
+	if sid := srv.Sessions.GetString(ctx, key); sid != "" {
+		if err := srv.DB.DeleteSession(sid); err != nil {
+			return err
+		}
+	}
+	var session = &ordersystem.LoginSession{
+		ID:       id.New(24, id.AlphanumCaseSensitiveDigits),
+		Kind:     kind,
+		Subject:  subject,
+		Created:  ordersystem.Today(),
+		LastSeen: ordersystem.Today(),
+	}
+	if err := srv.DB.CreateSession(session); err != nil {
+		return err
+	}
+	srv.Sessions.Put(ctx, key, session.ID)
+	return nil
+}
+
+// sessionValid returns whether the session is in the session index with the given subject, so it has not been revoked.
+func (srv *Server) sessionValid(ctx context.Context, kind ordersystem.SessionKind, subject string) (bool, error) {
+	session, err := srv.DB.ReadSession(srv.Sessions.GetString(ctx, sidKey(kind, subject)))
+	if errors.Is(err, ordersystem.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if session.Kind != kind || session.Subject != subject {
+		return false, nil
+	}
+	if today := ordersystem.Today(); session.LastSeen != today {
+		if err := srv.DB.UpdateSessionSeen(session, today); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// deleteIdleSessions removes index entries of sessions which have expired because of the idle timeout.
+func (srv *Server) deleteIdleSessions() error {
+	var idleDays = int(srv.Sessions.IdleTimeout/(24*time.Hour)) + 1 // LastSeen has day granularity
+	before, err := ordersystem.Today().AddDays(-idleDays)
+	if err != nil {
+		return err
+	}
+	return srv.DB.DeleteIdleSessions(before)
 }
 
 func (srv *Server) logout(ctx context.Context) {
+	var keys = []string{sidKey(ordersystem.StoreSession, "")}
+	for _, collID := range srv.sessionCollIDs(ctx) {
+		keys = append(keys, sidKey(ordersystem.ClientSession, collID))
+	}
+	for _, key := range keys {
+		if sid := srv.Sessions.GetString(ctx, key); sid != "" {
+			if err := srv.DB.DeleteSession(sid); err != nil {
+				log.Printf("error deleting session from index: %v", err)
+			}
+		}
+	}
 	srv.Sessions.Destroy(ctx)
 }
 
+// csrfToken returns the CSRF token of the session. It is created on first use.
+func (srv *Server) csrfToken(ctx context.Context) string {
+	var token = srv.Sessions.GetString(ctx, "csrf")
+	if token == "" {
+		token = id.New(32, id.AlphanumCaseSensitiveDigits)
+		srv.Sessions.Put(ctx, "csrf", token)
+	}
+	return token
+}
+
+// csrfValid returns true if the request is not a POST request or if it carries the CSRF token of the session.
+func (srv *Server) csrfValid(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return true
+	}
+	var token = srv.Sessions.GetString(r.Context(), "csrf")
+	return token != "" && subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(token)) == 1
+}
+
 // adds a notification to the session
 func (srv *Server) notify(ctx context.Context, format string, a ...interface{}) {
 	var ns, _ = srv.Sessions.Get(ctx, "ns").([]string)
@@ -63,6 +215,19 @@ func (srv *Server) notifications(ctx context.Context) []string {
 	return ns
 }
 
+// sessionCollID returns the current collection of the session.
 func (srv *Server) sessionCollID(r *http.Request) string {
-	return srv.Sessions.GetString(r.Context(), "coll-id")
+	if ids := srv.sessionCollIDs(r.Context()); len(ids) > 0 {
+		return ids[len(ids)-1]
+	}
+	return ""
+}
+
+func (srv *Server) sessionUsername(r *http.Request) string {
+	return srv.Sessions.GetString(r.Context(), "username")
+}
+
+// sessionRole looks up the role in the config, so changes apply without logging in again.
+func (srv *Server) sessionRole(r *http.Request) ordersystem.Role {
+	return srv.DB.Config.Role(srv.sessionUsername(r))
 }
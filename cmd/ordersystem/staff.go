@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/dys2p/ordersystem"
+	"github.com/dys2p/ordersystem/html"
+)
+
+// staffEventsLimit limits the number of staff events in the feed and in a digest.
+const staffEventsLimit = 200
+
+// staffEventsDays is the number of days after which staff events are deleted.
+const staffEventsDays = 30
+
+// staffFeed returns the subscribed staff events after afterID, newest first.
+func (srv *Server) staffFeed(settings *ordersystem.StaffSettings, afterID int) ([]*ordersystem.StaffEvent, error) {
+	events, err := srv.DB.ReadStaffEvents(afterID, staffEventsLimit)
+	if err != nil {
+		return nil, err
+	}
+	var result []*ordersystem.StaffEvent
+	for _, event := range events {
+		if settings.Subscribed(event.Kind) {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+// StaffDigests sends each store user who wants digests the subscribed staff events since their last digest, and deletes old staff events.
+func (srv *Server) StaffDigests() error {
+	all, err := srv.DB.ReadAllStaffSettings()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, settings := range all {
+		if settings.DigestProtocol == "" || settings.DigestAddress == "" {
+			continue
+		}
+		if err := srv.staffDigest(settings); err != nil {
+			errs = append(errs, fmt.Errorf("digest for %s: %w", settings.Username, err))
+		}
+	}
+
+	before, err := ordersystem.Today().AddDays(-staffEventsDays)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	if err := srv.DB.DeleteStaffEvents(before); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (srv *Server) staffDigest(settings *ordersystem.StaffSettings) error {
+	notifier, ok := srv.Notifiers[settings.DigestProtocol]
+	if !ok {
+		return fmt.Errorf("no notifier for protocol %s", settings.DigestProtocol)
+	}
+
+	// find the latest event ID before filtering, so unsubscribed events are not considered again
+	events, err := srv.DB.ReadStaffEvents(settings.LastDigest, staffEventsLimit)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	var lastID = events[0].ID
+
+	var subscribed []*ordersystem.StaffEvent
+	for _, event := range events {
+		if settings.Subscribed(event.Kind) {
+			subscribed = append(subscribed, event)
+		}
+	}
+
+	if len(subscribed) > 0 {
+		var body = &bytes.Buffer{}
+		if err := html.StaffDigest.Execute(body, subscribed); err != nil {
+			return err
+		}
+		if err := notifier.Send(settings.DigestAddress, fmt.Sprintf("%d neue Ereignisse im Bestellsystem", len(subscribed)), body.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	settings.LastDigest = lastID
+	return srv.DB.UpdateStaffSettings(settings)
+}
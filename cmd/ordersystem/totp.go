@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/dys2p/ordersystem"
+	"github.com/dys2p/ordersystem/html"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const totpIssuer = "ordersystem"
+
+// totpLoginTimeout is the time between password and TOTP login steps.
+const totpLoginTimeout = 5 * time.Minute
+
+type storeLoginTOTP struct {
+	html.TemplateData
+	Err bool
+}
+
+func (srv *Server) storeLoginTOTPGet(w http.ResponseWriter, r *http.Request) error {
+	if srv.Sessions.GetString(r.Context(), "totp-username") == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+	return html.StoreLoginTOTP.Execute(w, storeLoginTOTP{TemplateData: srv.storeTemplateData(r)})
+}
+
+// storeLoginTOTPPost is the second login step. It accepts a TOTP code or a recovery code.
+func (srv *Server) storeLoginTOTPPost(w http.ResponseWriter, r *http.Request) error {
+	var username = srv.Sessions.GetString(r.Context(), "totp-username")
+	var since = time.Unix(srv.Sessions.GetInt64(r.Context(), "totp-time"), 0)
+	if username == "" || time.Since(since) > totpLoginTimeout {
+		srv.Sessions.Remove(r.Context(), "totp-username")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	guard, err := srv.guardLogin(r, ordersystem.StoreLoginKey(username))
+	if err != nil {
+		return err
+	}
+	if guard.locked() {
+		srv.Sessions.Remove(r.Context(), "totp-username")
+		return html.StoreLogin.Execute(w, storeLogin{
+			TemplateData: srv.storeTemplateData(r),
+			Username:     username,
+			LockedUntil:  guard.LockedUntil.Format("15:04"),
+		})
+	}
+
+	t, err := srv.DB.ReadTOTP(username)
+	if err != nil {
+		return err
+	}
+	var code = r.PostFormValue("code")
+	var ok = t.Verify(code, time.Now())
+	var recovery = false
+	if !ok {
+		ok = t.UseRecoveryCode(code)
+		recovery = ok
+	}
+	if !ok {
+		if err := srv.audit(username, ordersystem.AuditLoginFailed, srv.loginSource(r)); err != nil {
+			return err
+		}
+		if _, err := srv.loginFailed(guard); err != nil {
+			return err
+		}
+		return html.StoreLoginTOTP.Execute(w, storeLoginTOTP{TemplateData: srv.storeTemplateData(r), Err: true})
+	}
+	if err := srv.DB.UpdateTOTP(t); err != nil {
+		return err
+	}
+	if err := srv.loginSucceeded(guard); err != nil {
+		return err
+	}
+
+	srv.Sessions.Remove(r.Context(), "totp-username")
+	srv.Sessions.Remove(r.Context(), "totp-time")
+	if err := srv.loginStore(r.Context(), username); err != nil {
+		return err
+	}
+	if err := srv.audit(username, ordersystem.AuditLogin, srv.loginSource(r)); err != nil {
+		return err
+	}
+	if recovery {
+		srv.notify(r.Context(), "Du hast einen Wiederherstellungscode verwendet. Es sind noch %d übrig.", len(t.RecoveryHashes))
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+type storeTOTP struct {
+	html.TemplateData
+	TOTP          *ordersystem.TOTP // nil if not enrolled
+	QR            template.URL      // while enrolment is not confirmed
+	RecoveryCodes []string          // shown once
+	Required      bool
+	Err           bool
+	Notifications []string
+}
+
+func (srv *Server) storeTOTPGet(w http.ResponseWriter, r *http.Request) error {
+	return srv.storeTOTPPage(w, r, nil, false)
+}
+
+func (srv *Server) storeTOTPPage(w http.ResponseWriter, r *http.Request, recoveryCodes []string, wrongCode bool) error {
+	t, err := srv.DB.ReadTOTP(srv.sessionUsername(r))
+	if errors.Is(err, ordersystem.ErrNotFound) {
+		t = nil
+	} else if err != nil {
+		return err
+	}
+
+	var data = storeTOTP{
+		TemplateData:  srv.storeTemplateData(r),
+		TOTP:          t,
+		RecoveryCodes: recoveryCodes,
+		Required:      srv.DB.Config.RequireTOTP,
+		Err:           wrongCode,
+		Notifications: srv.notifications(r.Context()),
+	}
+	if t != nil && !t.Confirmed {
+		png, err := qrcode.Encode(t.URI(totpIssuer), qrcode.Medium, 256)
+		if err != nil {
+			return err
+		}
+		data.QR = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+	return html.StoreTOTP.Execute(w, data)
+}
+
+// storeTOTPEnrolPost creates a new secret. It replaces an unconfirmed one.
+func (srv *Server) storeTOTPEnrolPost(w http.ResponseWriter, r *http.Request) error {
+	var username = srv.sessionUsername(r)
+	if t, err := srv.DB.ReadTOTP(username); err == nil && t.Confirmed {
+		return errors.New("TOTP has been set up already")
+	}
+	t, err := ordersystem.NewTOTP(username)
+	if err != nil {
+		return err
+	}
+	if err := srv.DB.UpdateTOTP(t); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/totp", http.StatusSeeOther)
+	return nil
+}
+
+// storeTOTPConfirmPost completes the enrolment and shows the recovery codes.
+func (srv *Server) storeTOTPConfirmPost(w http.ResponseWriter, r *http.Request) error {
+	t, err := srv.DB.ReadTOTP(srv.sessionUsername(r))
+	if err != nil {
+		return err
+	}
+	if t.Confirmed {
+		return errors.New("TOTP has been confirmed already")
+	}
+	if !t.Verify(r.PostFormValue("code"), time.Now()) {
+		return srv.storeTOTPPage(w, r, nil, true)
+	}
+	t.Confirmed = true
+	codes, err := t.GenerateRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	if err := srv.DB.UpdateTOTP(t); err != nil {
+		return err
+	}
+	srv.Sessions.Remove(r.Context(), "totp-required")
+	return srv.storeTOTPPage(w, r, codes, false)
+}
+
+// storeTOTPRecoveryPost replaces the recovery codes. It requires a valid TOTP code.
+func (srv *Server) storeTOTPRecoveryPost(w http.ResponseWriter, r *http.Request) error {
+	t, err := srv.DB.ReadTOTP(srv.sessionUsername(r))
+	if err != nil {
+		return err
+	}
+	if !t.Confirmed || !t.Verify(r.PostFormValue("code"), time.Now()) {
+		return srv.storeTOTPPage(w, r, nil, true)
+	}
+	codes, err := t.GenerateRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	if err := srv.DB.UpdateTOTP(t); err != nil {
+		return err
+	}
+	return srv.storeTOTPPage(w, r, codes, false)
+}
+
+// storeTOTPDisablePost removes the second factor. It requires a valid TOTP code and is not possible if TOTP is required.
+func (srv *Server) storeTOTPDisablePost(w http.ResponseWriter, r *http.Request) error {
+	if srv.DB.Config.RequireTOTP {
+		return errors.New("TOTP is required")
+	}
+	t, err := srv.DB.ReadTOTP(srv.sessionUsername(r))
+	if err != nil {
+		return err
+	}
+	if t.Confirmed && !t.Verify(r.PostFormValue("code"), time.Now()) {
+		return srv.storeTOTPPage(w, r, nil, true)
+	}
+	if err := srv.DB.DeleteTOTP(t.Username); err != nil {
+		return err
+	}
+	srv.notify(r.Context(), "Die Zwei-Faktor-Authentifizierung wurde deaktiviert.")
+	http.Redirect(w, r, "/totp", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dys2p/btcpay"
+)
+
+const (
+	processedWebhookDays   = 30
+	rejectedWebhookDays    = 30
+	rejectedWebhookLimit   = 50
+	rejectedWebhookPayload = 4096 // bytes, the sender is not authenticated
+)
+
+// errWebhookRejected wraps errors of deliveries which will never be accepted, so BTCPay should not redeliver them.
+var errWebhookRejected = errors.New("webhook rejected")
+
+// verifyWebhook checks the signature and the store ID like btcpay.ServerStore.ProcessWebhook does, so we can tell these permanent errors from transient ones.
+// The dummy store does not sign webhooks.
+func verifyWebhook(store btcpay.Store, r *http.Request, body []byte) error {
+	serverStore, ok := store.(*btcpay.ServerStore)
+	if !ok {
+		return nil
+	}
+
+	var messageMAC = []byte(strings.TrimPrefix(r.Header.Get("BTCPay-Sig"), "sha256="))
+	var mac = hmac.New(sha256.New, []byte(serverStore.WebhookSecret))
+	mac.Write(body)
+	if !hmac.Equal(messageMAC, []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return fmt.Errorf("%w: signature mismatch", errWebhookRejected)
+	}
+
+	var event btcpay.InvoiceEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return fmt.Errorf("%w: %v", errWebhookRejected, err)
+	}
+	if event.StoreID != serverStore.ID {
+		return fmt.Errorf("%w: store ID %s does not match %s", errWebhookRejected, event.StoreID, serverStore.ID)
+	}
+	return nil
+}
+
+// rejectWebhook stores a rejected delivery apart from the inbox.
+func (srv *Server) rejectWebhook(rejectErr error, body []byte) error {
+	if len(body) > rejectedWebhookPayload {
+		body = body[:rejectedWebhookPayload]
+	}
+	return srv.DB.CreateRejectedWebhook(time.Now(), rejectErr, string(body))
+}
+
+// pruneWebhooks deletes processed and rejected webhooks. Failed and pending webhooks are kept until they have been processed.
+func (srv *Server) pruneWebhooks() error {
+	return errors.Join(
+		srv.DB.PruneWebhooks(time.Now().AddDate(0, 0, -processedWebhookDays)),
+		srv.DB.DeleteRejectedWebhooks(time.Now().AddDate(0, 0, -rejectedWebhookDays)),
+	)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dys2p/btcpay"
+)
+
+func signedWebhookRequest(secret, body string) *http.Request {
+	var mac = hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	var r = httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(body))
+	r.Header.Set("BTCPay-Sig", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestRPCRejects(t *testing.T) {
+	srv, _, _ := newReconcileServer(t)
+	srv.BtcPayStore = &btcpay.ServerStore{ID: "store", WebhookSecret: "secret"}
+
+	const body = `{"deliveryId":"1","storeId":"other","invoiceId":"inv","type":"InvoiceSettled"}`
+	for _, r := range []*http.Request{
+		signedWebhookRequest("wrong", body),
+		signedWebhookRequest("secret", body),
+	} {
+		var w = httptest.NewRecorder()
+		srv.rpc(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+		}
+	}
+
+	rejected, err := srv.DB.ReadRejectedWebhooks(rejectedWebhookLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 2 || !strings.Contains(rejected[0].Error, "store ID") || !strings.Contains(rejected[1].Error, "signature") {
+		t.Errorf("got rejected webhooks %+v", rejected)
+	}
+	if _, err := srv.DB.ReadWebhookByDelivery("1"); err == nil {
+		t.Error("rejected webhook has been stored in the inbox")
+	}
+
+	var valid = strings.Replace(body, "other", "store", 1)
+	if err := verifyWebhook(srv.BtcPayStore, signedWebhookRequest("secret", valid), []byte(valid)); err != nil {
+		t.Errorf("valid webhook: %v", err)
+	}
+}
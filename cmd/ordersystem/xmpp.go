@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// XMPP sends notifications from a bot account. It connects for each message, which is fine for a small number of notifications.
+// Messages are not OTR-encrypted, so they must not contain details.
+type XMPP struct {
+	JID      string `json:"jid"`      // bot account, like "bot@example.com"
+	Password string `json:"password"` //
+	Host     string `json:"host"`     // optional, default: domain of JID, port 5222
+	NoTLS    bool   `json:"no-tls"`   // for local test servers only
+}
+
+func LoadXMPP(jsonPath string) (*XMPP, error) {
+	data, err := os.ReadFile(jsonPath)
+	if err != nil {
+		return nil, err
+	}
+	var x = &XMPP{}
+	if err := json.Unmarshal(data, x); err != nil {
+		return nil, fmt.Errorf("unmarshaling json: %w", err)
+	}
+	if _, _, ok := strings.Cut(x.JID, "@"); !ok {
+		return nil, fmt.Errorf("invalid jid: %s", x.JID)
+	}
+	return x, nil
+}
+
+type xmppFeatures struct {
+	StartTLS   *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	Mechanisms []string  `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms>mechanism"`
+	Bind       *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+}
+
+type xmppMessage struct {
+	XMLName xml.Name `xml:"jabber:client message"`
+	To      string   `xml:"to,attr"`
+	Type    string   `xml:"type,attr"`
+	Body    string   `xml:"body"`
+}
+
+func (x *XMPP) Send(to string, subject string, body []byte) error {
+	if _, _, ok := strings.Cut(to, "@"); !ok || strings.ContainsAny(to, " <>'\"") {
+		return fmt.Errorf("invalid jid: %s", to)
+	}
+
+	user, domain, _ := strings.Cut(x.JID, "@")
+	var host = x.Host
+	if host == "" {
+		host = domain
+	}
+	if !strings.Contains(host, ":") {
+		host = host + ":5222"
+	}
+
+	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	var rw io.ReadWriter = conn
+	features, dec, err := xmppOpenStream(rw, domain)
+	if err != nil {
+		return err
+	}
+
+	// TLS
+
+	if !x.NoTLS {
+		if features.StartTLS == nil {
+			return errors.New("server does not offer starttls")
+		}
+		if _, err := io.WriteString(rw, "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>"); err != nil {
+			return err
+		}
+		if err := xmppExpect(dec, "proceed"); err != nil {
+			return err
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: domain})
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		rw = tlsConn
+		features, dec, err = xmppOpenStream(rw, domain)
+		if err != nil {
+			return err
+		}
+	}
+
+	// authentication
+
+	var plain = false
+	for _, mechanism := range features.Mechanisms {
+		if mechanism == "PLAIN" {
+			plain = true
+		}
+	}
+	if !plain {
+		return errors.New("server does not offer sasl plain")
+	}
+	var credentials = base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + x.Password))
+	if _, err := fmt.Fprintf(rw, "<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>%s</auth>", credentials); err != nil {
+		return err
+	}
+	if err := xmppExpect(dec, "success"); err != nil {
+		return err
+	}
+	features, dec, err = xmppOpenStream(rw, domain)
+	if err != nil {
+		return err
+	}
+
+	// resource binding
+
+	if features.Bind != nil {
+		if _, err := io.WriteString(rw, "<iq type='set' id='bind'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></iq>"); err != nil {
+			return err
+		}
+		if err := xmppExpect(dec, "iq"); err != nil {
+			return err
+		}
+	}
+
+	// message
+
+	msg, err := xml.Marshal(xmppMessage{
+		To:   to,
+		Type: "chat",
+		Body: string(body),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := rw.Write(msg); err != nil {
+		return err
+	}
+	_, err = io.WriteString(rw, "</stream:stream>")
+	return err
+}
+
+// xmppOpenStream opens a new stream and reads the stream features.
+func xmppOpenStream(rw io.ReadWriter, domain string) (*xmppFeatures, *xml.Decoder, error) {
+	if _, err := fmt.Fprintf(rw, "<?xml version='1.0'?><stream:stream to='%s' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>", domain); err != nil {
+		return nil, nil, err
+	}
+	var dec = xml.NewDecoder(rw)
+	start, err := xmppNext(dec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if start.Name.Local != "stream" {
+		return nil, nil, fmt.Errorf("expected stream, got %s", start.Name.Local)
+	}
+	start, err = xmppNext(dec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if start.Name.Local != "features" {
+		return nil, nil, fmt.Errorf("expected features, got %s", start.Name.Local)
+	}
+	var features = &xmppFeatures{}
+	if err := dec.DecodeElement(features, &start); err != nil {
+		return nil, nil, err
+	}
+	return features, dec, nil
+}
+
+// xmppExpect reads the next element and returns an error if it has another name, e.g. "failure".
+func xmppExpect(dec *xml.Decoder, name string) error {
+	start, err := xmppNext(dec)
+	if err != nil {
+		return err
+	}
+	if start.Name.Local != name {
+		return fmt.Errorf("expected %s, got %s", name, start.Name.Local)
+	}
+	if start.Name.Local == "iq" {
+		for _, attr := range start.Attr {
+			if attr.Name.Local == "type" && attr.Value == "error" {
+				return errors.New("iq error")
+			}
+		}
+	}
+	return dec.Skip()
+}
+
+func xmppNext(dec *xml.Decoder) (xml.StartElement, error) {
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start, nil
+		}
+	}
+}
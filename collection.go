@@ -4,8 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
-	"time"
 
 	"github.com/dys2p/eco/delivery"
 	"github.com/dys2p/eco/id"
@@ -49,6 +49,11 @@ func (coll *Collection) ClientCan(action string) bool {
 	return CollFSM.CanAction(Client, State(coll.State), action)
 }
 
+// ExceedsMaxTotal returns whether the client has set a budget and the sum exceeds it.
+func (coll *Collection) ExceedsMaxTotal() bool {
+	return coll.MaxTotal > 0 && coll.Sum() > coll.MaxTotal
+}
+
 func HashPassword(password string) ([]byte, error) {
 	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 }
@@ -67,18 +72,19 @@ func (coll *Collection) GetTask(id string) (*Task, bool) {
 	return nil, false
 }
 
-func (coll *Collection) LatestEventSince() (time.Duration, error) {
-	var latest time.Time
+// Headroom returns how much the sum can rise until it reaches the budget. It is negative if the budget is exceeded.
+func (coll *Collection) Headroom() int {
+	return coll.MaxTotal - coll.Sum()
+}
+
+// HasPayments returns whether any payment or refund has been booked.
+func (coll *Collection) HasPayments() bool {
 	for _, event := range coll.Log {
-		t, err := event.Date.Parse()
-		if err != nil {
-			return 0, err
-		}
-		if t.After(latest) {
-			latest = t
+		if event.Paid != 0 {
+			return true
 		}
 	}
-	return time.Since(latest), nil
+	return false
 }
 
 // Link returns an absolute URL without host, like "/collection/ABCDEFGHKL"
@@ -123,6 +129,7 @@ func (coll *Collection) Merge(actor Actor, untrustedColl *Collection) error {
 		coll.DeliveryMethodID = untrustedColl.DeliveryMethodID
 		coll.DeliveryGrossPrice = untrustedColl.DeliveryGrossPrice
 		coll.ShippingServiceID = untrustedColl.ShippingServiceID
+		coll.MaxTotal = max(untrustedColl.MaxTotal, 0) // only the client sets the budget
 		// don't modify coll.StoreInput
 	case Store:
 		coll.ClientContact = untrustedColl.ClientContact
@@ -164,6 +171,64 @@ func (coll *Collection) Merge(actor Actor, untrustedColl *Collection) error {
 	return nil
 }
 
+// CanReorder returns whether the collection is over and has tasks which the client can copy into a new draft.
+func (coll *Collection) CanReorder() bool {
+	switch coll.State {
+	case Archived, Cancelled, Finalized, Rejected:
+		return len(coll.Tasks) > 0
+	default:
+		return false
+	}
+}
+
+// ReorderTasks returns copies of the tasks with new IDs and without state, so they start as NotOrderedYet.
+// Only merchant and articles are copied. Shipping fee and additional costs depend on the order and are entered again.
+func (coll *Collection) ReorderTasks() TaskList {
+	var tasks = make(TaskList, 0, len(coll.Tasks))
+	for _, task := range coll.Tasks {
+		tasks = append(tasks, &Task{
+			ID: id.New(10, id.AlphanumCaseInsensitiveDigits),
+			TaskData: TaskData{
+				Articles: slices.Clone(task.Articles),
+				Merchant: task.Merchant,
+			},
+		})
+	}
+	return tasks
+}
+
+// Settled returns whether no money is owed by either side, i.e. the collection has been paid in full or nothing has been paid (or everything has been refunded).
+func (coll *Collection) Settled() bool {
+	return coll.Due() == 0 || coll.Paid() == 0
+}
+
+// Wipe removes the given personal data fields and returns whether anything has changed.
+// DeliveryMethodID and CountryID are kept because we need them for VAT.
+func (coll *Collection) Wipe(fields []string) bool {
+	var changed = false
+	for _, field := range fields {
+		switch field {
+		case WipeClientContact:
+			if coll.ClientContact != "" || coll.ClientContactProtocol != "" {
+				coll.ClientContact = ""
+				coll.ClientContactProtocol = ""
+				changed = true
+			}
+		case WipeDeliveryAddress:
+			if coll.DeliveryAddress != (delivery.Address{}) {
+				coll.DeliveryAddress = delivery.Address{}
+				changed = true
+			}
+		case WipeDeliveryTrackingIDs:
+			if len(coll.DeliveryTrackingIDs) > 0 {
+				coll.DeliveryTrackingIDs = nil
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
 func (coll *Collection) NumTasks() int {
 	return len(coll.Tasks)
 }
@@ -178,6 +243,18 @@ func (coll *Collection) NumTasksAt(state TaskState) int {
 	return num
 }
 
+// StateSince returns the date when the collection has entered its current state.
+func (coll *Collection) StateSince() Date {
+	var since Date
+	for _, event := range coll.Log { // newest first
+		if event.NewState != coll.State {
+			break
+		}
+		since = event.Date
+	}
+	return since
+}
+
 func (coll *Collection) Due() int {
 	return coll.Sum() - coll.Paid()
 }
@@ -212,9 +289,27 @@ func (coll *Collection) StoreCanTask(action string, task *Task) bool {
 
 // CollectionData is a separate struct so we can marshal it easily and store it in the SQL database.
 type CollectionData struct {
-	BookedInvoices         []string `json:"booked-invoices"`           // bitpay.Invoice.ID, booking is triggered by the invoice settled webhook
-	ReceivedInTimePayments []string `json:"received-in-time-payments"` // bitpay.Invoice.InvoiceData.CryptoInfo.Payments.ID, event log like "Vorläufiger Zahlungseingang"
-	ReceivedLatePayments   []string `json:"received-late-payments"`    // bitpay.Invoice.InvoiceData.CryptoInfo.Payments.ID, event log like "Verspäterer vorläufiger Zahlungseingang"
+	BookedInvoices         []string     `json:"booked-invoices"`           // bitpay.Invoice.ID, legacy: booked invoices are recorded in the invoice table now, see DB.BookInvoice
+	ReceivedInTimePayments []string     `json:"received-in-time-payments"` // bitpay.Invoice.InvoiceData.CryptoInfo.Payments.ID, event log like "Vorläufiger Zahlungseingang"
+	ReceivedLatePayments   []string     `json:"received-late-payments"`    // bitpay.Invoice.InvoiceData.CryptoInfo.Payments.ID, event log like "Verspäterer vorläufiger Zahlungseingang"
+	PaymentReminders       []Date       `json:"payment-reminders"`         // dates when the bot has sent a payment reminder
+	NotificationsOptOut    bool         `json:"notifications-opt-out"`
+	ResetCodeHash          string       `json:"reset-code-hash,omitempty"`    // bcrypt, see NewResetCode
+	ResetCodeExpires       int64        `json:"reset-code-expires,omitempty"` // unix time
+	Assignee               string       `json:"assignee,omitempty"`           // store user who has claimed the collection
+	PriceChange            *PriceChange `json:"price-change,omitempty"`       // waits for client approval
+	MaxTotal               int          `json:"max-total,omitempty"`          // budget of the client in cents, zero means no limit
+}
+
+// PaymentRemindersSince returns the number of payment reminders which have been sent at or after the given date.
+func (data *CollectionData) PaymentRemindersSince(date Date) int {
+	var n = 0
+	for _, d := range data.PaymentReminders {
+		if d >= date {
+			n++
+		}
+	}
+	return n
 }
 
 func (data *CollectionData) InvoiceHasBeenBooked(invoiceID string) bool {
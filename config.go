@@ -0,0 +1,135 @@
+package ordersystem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// Config contains the thresholds of the bot and the roles of the store users. All durations are in days.
+type Config struct {
+	ClientURL            string                        `json:"client-url"`            // used in notifications
+	PaymentReminderDays  []int                         `json:"payment-reminder-days"` // after the collection has been accepted
+	CancelUnpaidDays     int                           `json:"cancel-unpaid-days"`    // after the collection has been accepted, zero disables cancellation
+	Retention            map[CollState]RetentionPolicy `json:"retention"`
+	Roles                map[string]Role               `json:"roles"`                  // key: username
+	RequireTOTP          bool                          `json:"require-totp"`           // store users must enrol a second factor
+	AuditRetentionDays   int                           `json:"audit-retention-days"`   // zero keeps the audit log forever
+	PriceChangeTolerance int                           `json:"price-change-tolerance"` // in cents, store edits of accepted or active collections which raise the sum by more require client approval
+	ProxyHeader          string                        `json:"proxy-header"`           // request header in which the reverse proxy passes the client address, like "X-Forwarded-For", empty if it doesn't
+}
+
+// Fields which can be wiped by a retention policy.
+const (
+	WipeClientContact       = "client-contact"
+	WipeDeliveryAddress     = "delivery-address"
+	WipeDeliveryTrackingIDs = "delivery-tracking-ids"
+)
+
+// RetentionPolicy applies to collections in a certain state. Durations are counted from the latest event of the collection. Zero disables the action.
+type RetentionPolicy struct {
+	ArchiveDays int      `json:"archive-days"`
+	DeleteDays  int      `json:"delete-days"`
+	Wipe        []string `json:"wipe"` // fields which are wiped on archiving
+}
+
+func DefaultConfig() *Config {
+	var wipeAll = []string{WipeClientContact, WipeDeliveryAddress, WipeDeliveryTrackingIDs}
+	return &Config{
+		ClientURL:           "https://order.proxysto.re",
+		PaymentReminderDays: []int{3, 7},
+		CancelUnpaidDays:    14,
+		AuditRetentionDays:  365,
+		Retention: map[CollState]RetentionPolicy{
+			Cancelled: {ArchiveDays: 14, DeleteDays: 90, Wipe: wipeAll},
+			Draft:     {DeleteDays: 14},
+			Finalized: {ArchiveDays: 14, Wipe: wipeAll},
+			Rejected:  {ArchiveDays: 14, DeleteDays: 90, Wipe: wipeAll},
+			Spam:      {DeleteDays: 14},
+		},
+	}
+}
+
+// LoadConfig reads the config from a JSON file. If the file does not exist, the default config is returned. Missing fields are set to their default values.
+func LoadConfig(filename string) (*Config, error) {
+	var config = DefaultConfig()
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// json.Unmarshal would merge the retention policies into the default map, but they replace it
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("unmarshaling config: %w", err)
+	}
+	if _, ok := fields["retention"]; ok {
+		config.Retention = nil
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("unmarshaling config: %w", err)
+	}
+	return config, config.validate()
+}
+
+func (config *Config) validate() error {
+	if !slices.IsSorted(config.PaymentReminderDays) {
+		return errors.New("payment reminder days must be in ascending order")
+	}
+	for _, days := range config.PaymentReminderDays {
+		if days <= 0 {
+			return errors.New("payment reminder days must be positive")
+		}
+		if config.CancelUnpaidDays > 0 && days >= config.CancelUnpaidDays {
+			return errors.New("payment reminders must be sent before cancellation")
+		}
+	}
+	if config.CancelUnpaidDays < 0 {
+		return errors.New("cancel unpaid days must not be negative")
+	}
+	if config.AuditRetentionDays < 0 {
+		return errors.New("audit retention days must not be negative")
+	}
+	if config.PriceChangeTolerance < 0 {
+		return errors.New("price change tolerance must not be negative")
+	}
+	for username, role := range config.Roles {
+		if !slices.Contains(Roles, role) {
+			return fmt.Errorf("role of %s: unknown role %s", username, role)
+		}
+	}
+	for state, policy := range config.Retention {
+		if policy.ArchiveDays < 0 || policy.DeleteDays < 0 {
+			return fmt.Errorf("retention of %s: days must not be negative", state)
+		}
+		if policy.ArchiveDays > 0 && !CollFSM.CanAction(Bot, State(state), "archive") {
+			return fmt.Errorf("retention of %s: collections in this state can't be archived", state)
+		}
+		if policy.DeleteDays > 0 && !CollFSM.CanAction(Bot, State(state), "delete") {
+			return fmt.Errorf("retention of %s: collections in this state can't be deleted", state)
+		}
+		for _, field := range policy.Wipe {
+			switch field {
+			case WipeClientContact, WipeDeliveryAddress, WipeDeliveryTrackingIDs:
+			default:
+				return fmt.Errorf("retention of %s: unknown field %s", state, field)
+			}
+		}
+	}
+	return nil
+}
+
+// Role returns the role of a store user. If no roles are configured, every user is an admin. Else users without a role are viewers.
+func (config *Config) Role(username string) Role {
+	if len(config.Roles) == 0 {
+		return RoleAdmin
+	}
+	if role, ok := config.Roles[username]; ok {
+		return role
+	}
+	return RoleViewer
+}
@@ -23,3 +23,24 @@ func (d Date) Format() (string, error) {
 func (d Date) Parse() (time.Time, error) {
 	return time.Parse(dateFmt, string(d))
 }
+
+func (d Date) AddDays(days int) (Date, error) {
+	t, err := d.Parse()
+	if err != nil {
+		return "", err
+	}
+	return Date(t.AddDate(0, 0, days).Format(dateFmt)), nil
+}
+
+// DaysSince returns the number of full days between the date and today.
+func (d Date) DaysSince() (int, error) {
+	t, err := d.Parse()
+	if err != nil {
+		return 0, err
+	}
+	today, err := Today().Parse()
+	if err != nil {
+		return 0, err
+	}
+	return int(today.Sub(t).Hours() / 24), nil
+}
@@ -5,13 +5,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/dys2p/eco/id"
 )
 
 var ErrNotFound = errors.New("not found")
 
 type DB struct {
-	sqlDB *sql.DB
+	sqlDB         *sql.DB
+	Config        *Config
+	attachmentDir string
 
 	// collection
 	createColl      *sql.Stmt
@@ -19,6 +27,8 @@ type DB struct {
 	readColls       *sql.Stmt
 	readState       *sql.Stmt
 	updateColl      *sql.Stmt
+	updateCollData  *sql.Stmt
+	updateCollPass  *sql.Stmt
 	updateCollState *sql.Stmt
 	deleteColl      *sql.Stmt
 
@@ -27,17 +37,124 @@ type DB struct {
 	readEvents   *sql.Stmt
 	deleteEvents *sql.Stmt
 
+	// attachment
+	createAttachment  *sql.Stmt
+	readAttachment    *sql.Stmt
+	readAttachments   *sql.Stmt
+	deleteAttachments *sql.Stmt
+
 	// task
 	createTask      *sql.Stmt
 	readTasks       *sql.Stmt
 	updateTaskState *sql.Stmt
 	deleteTasks     *sql.Stmt
+
+	// webhook
+	createWebhook         *sql.Stmt
+	readWebhook           *sql.Stmt
+	readWebhookByDelivery *sql.Stmt
+	readWebhooks          *sql.Stmt
+	updateWebhook         *sql.Stmt
+	deleteWebhooks        *sql.Stmt
+	pruneWebhooks         *sql.Stmt
+
+	// rejected webhook
+	createRejectedWebhook  *sql.Stmt
+	readRejectedWebhooks   *sql.Stmt
+	deleteRejectedWebhooks *sql.Stmt
+
+	// payment review
+	createPaymentReview  *sql.Stmt
+	readPaymentReview    *sql.Stmt
+	readPaymentReviews   *sql.Stmt
+	updatePaymentReview  *sql.Stmt
+	deletePaymentReviews *sql.Stmt
+
+	// invoice
+	bookInvoice         *sql.Stmt
+	createInvoice       *sql.Stmt
+	readInvoiceStatus   *sql.Stmt
+	readOpenInvoices    *sql.Stmt
+	readOpenInvoicesOf  *sql.Stmt
+	updateInvoiceStatus *sql.Stmt
+	deleteInvoices      *sql.Stmt
+
+	// refund
+	createRefund        *sql.Stmt
+	readRefunds         *sql.Stmt
+	readPendingRefunds  *sql.Stmt
+	readRefundable      *sql.Stmt
+	updateRefundBooking *sql.Stmt
+	deleteRefunds       *sql.Stmt
+
+	// job
+	createJob      *sql.Stmt
+	readJob        *sql.Stmt
+	readNextJob    *sql.Stmt
+	readFailedJobs *sql.Stmt
+	updateJob      *sql.Stmt
+	requeueJob     *sql.Stmt
+	deleteJob      *sql.Stmt
+
+	// notification
+	createNotification  *sql.Stmt
+	readNotifications   *sql.Stmt
+	readPendingNotified *sql.Stmt
+	updateNotification  *sql.Stmt
+	deleteNotifications *sql.Stmt
+
+	// feed
+	createFeedToken  *sql.Stmt
+	readFeedToken    *sql.Stmt
+	readFeedCollID   *sql.Stmt
+	deleteFeedTokens *sql.Stmt
+
+	// staff
+	createStaffEvent      *sql.Stmt
+	readStaffEvents       *sql.Stmt
+	deleteStaffEvents     *sql.Stmt
+	deleteCollStaffEvents *sql.Stmt
+	readStaffSettings     *sql.Stmt
+	readAllStaffSettings  *sql.Stmt
+	updateStaffSettings   *sql.Stmt
+
+	// totp
+	readTOTP   *sql.Stmt
+	updateTOTP *sql.Stmt
+	deleteTOTP *sql.Stmt
+
+	// login attempts
+	readLoginAttempt   *sql.Stmt
+	readLoginAttempts  *sql.Stmt
+	failLoginAttempt   *sql.Stmt
+	lockLoginAttempt   *sql.Stmt
+	deleteLoginAttempt *sql.Stmt
+	pruneLoginAttempts *sql.Stmt
+
+	// sessions
+	createSession       *sql.Stmt
+	readSession         *sql.Stmt
+	readSessions        *sql.Stmt
+	readSubjectSessions *sql.Stmt
+	updateSessionSeen   *sql.Stmt
+	deleteSession       *sql.Stmt
+	deleteOtherSessions *sql.Stmt
+	deleteIdleSessions  *sql.Stmt
+	deleteCollSessions  *sql.Stmt
+
+	// audit
+	createAuditEntry   *sql.Stmt
+	readAuditEntries   *sql.Stmt
+	deleteAuditEntries *sql.Stmt
 }
 
-func NewDB(sqlDB *sql.DB) (*DB, error) {
+// NewDB creates the tables and prepares the statements. Files of message attachments are stored in attachmentDir.
+func NewDB(sqlDB *sql.DB, config *Config, attachmentDir string) (*DB, error) {
 
 	var db = &DB{
-		sqlDB: sqlDB,
+		sqlDB:         sqlDB,
+		Config:        config,
+		attachmentDir: attachmentDir,
 	}
 
 	_, err := sqlDB.Exec(`
@@ -74,12 +191,133 @@ func NewDB(sqlDB *sql.DB) (*DB, error) {
 			paid      INTEGER NOT NULL,
 			text      text not null
 		);
+		create table if not exists attachment (
+			id      text    primary key,
+			collid  text    not null,
+			eventid integer not null,
+			name    text    not null,
+			type    text    not null,
+			size    integer not null
+		);
+		create index if not exists attachment_collid on attachment (collid);
 		create table if not exists task (
 			id     text primary key,
 			collid text not null,
 			state  text not null,
 			data   text not null
 		);
+		create table if not exists webhook (
+			id          integer primary key,
+			delivery_id text not null unique,
+			invoice_id  text not null,
+			type        text not null,
+			payload     text not null,
+			status      text not null,
+			error       text not null,
+			attempts    int  not null,
+			received    int  not null,
+			processed   int  not null
+		);
+		create table if not exists rejected_webhook (
+			id       integer primary key,
+			received int  not null,
+			error    text not null,
+			payload  text not null
+		);
+		create table if not exists payment_review (
+			id            integer primary key,
+			collid        text not null,
+			invoice_id    text not null,
+			payment_id    text not null unique,
+			kind          text not null,
+			crypto_code   text not null,
+			crypto_amount real not null,
+			rate          real not null,
+			status        text not null,
+			booked_cents  int  not null,
+			created       text not null,
+			history       text not null -- json array
+		);
+		create table if not exists invoice (
+			id      text primary key,
+			collid  text not null,
+			created text not null,
+			status  text not null
+		);
+		create table if not exists refund (
+			id           text primary key,
+			collid       text not null,
+			cents        int  not null,
+			claim_link   text not null,
+			status       text not null,
+			created      text not null,
+			booked_cents int  not null
+		);
+		create table if not exists job (
+			id         integer primary key,
+			kind       text not null,
+			collid     text not null,
+			run_at     int  not null, -- unix time
+			attempts   int  not null,
+			last_error text not null,
+			failed     int  not null,
+			generation int  not null -- incremented when the job is requested again
+		);
+		create unique index if not exists job_active on job (kind, collid) where failed = 0;
+		create table if not exists notification (
+			id         integer primary key,
+			collid     text not null,
+			kind       text not null,
+			collstate  text not null,
+			status     text not null,
+			attempts   int  not null,
+			last_error text not null,
+			created    text not null,
+			sent       text not null
+		);
+		create table if not exists feed_token (
+			token  text primary key,
+			collid text not null unique
+		);
+		create table if not exists staff_event (
+			id      integer primary key,
+			kind    text not null,
+			collid  text not null,
+			created text not null
+		);
+		create table if not exists staff_settings (
+			username text primary key,
+			data     text not null
+		);
+		create table if not exists totp (
+			username  text primary key,
+			secret    text not null,
+			confirmed integer not null,
+			last_step integer not null,
+			recovery  text not null -- json
+		);
+		create table if not exists login_attempt (
+			key          text primary key,
+			failures     integer not null,
+			last_failure integer not null, -- unix time
+			locked_until integer not null  -- unix time
+		);
+		create table if not exists session (
+			id        text primary key,
+			kind      text not null,
+			subject   text not null,
+			created   text not null,
+			last_seen text not null
+		);
+		create index if not exists session_subject on session (kind, subject);
+		create table if not exists audit (
+			id       integer primary key,
+			time     integer not null, -- unix time
+			username text    not null,
+			action   text    not null,
+			target   text    not null
+		);
+		create index if not exists audit_time on audit (time);
 	`)
 	if err != nil {
 		return nil, err
@@ -112,6 +350,16 @@ func NewDB(sqlDB *sql.DB) (*DB, error) {
 		return nil, err
 	}
 
+	db.updateCollData, err = db.sqlDB.Prepare("update coll set data = ? where id = ?")
+	if err != nil {
+		return nil, err
+	}
+
+	db.updateCollPass, err = db.sqlDB.Prepare("update coll set pass = ?, data = ? where id = ?")
+	if err != nil {
+		return nil, err
+	}
+
 	db.updateCollState, err = db.sqlDB.Prepare("update coll set state = ? where id = ?")
 	if err != nil {
 		return nil, err
@@ -129,7 +377,7 @@ func NewDB(sqlDB *sql.DB) (*DB, error) {
 		return nil, err
 	}
 
-	db.readEvents, err = db.sqlDB.Prepare("select collstate, date, paid, text FROM event where collid = ? order by id desc")
+	db.readEvents, err = db.sqlDB.Prepare("select id, collstate, date, paid, text FROM event where collid = ? order by id desc")
 	if err != nil {
 		return nil, err
 	}
@@ -139,6 +387,28 @@ func NewDB(sqlDB *sql.DB) (*DB, error) {
 		return nil, err
 	}
 
+	// attachment
+
+	db.createAttachment, err = db.sqlDB.Prepare("insert into attachment (id, collid, eventid, name, type, size) values (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return nil, err
+	}
+
+	db.readAttachment, err = db.sqlDB.Prepare("select eventid, name, type, size from attachment where collid = ? and id = ? limit 1")
+	if err != nil {
+		return nil, err
+	}
+
+	db.readAttachments, err = db.sqlDB.Prepare("select id, eventid, name, type, size from attachment where collid = ? order by rowid")
+	if err != nil {
+		return nil, err
+	}
+
+	db.deleteAttachments, err = db.sqlDB.Prepare("delete from attachment where collid = ?")
+	if err != nil {
+		return nil, err
+	}
+
 	// task
 
 	db.createTask, err = db.sqlDB.Prepare("insert or replace into task (id, collid, state, data) values (?, ?, ?, ?)") // not upsert, which is useful for partial updates but not required here
@@ -161,245 +431,1850 @@ func NewDB(sqlDB *sql.DB) (*DB, error) {
 		return nil, err
 	}
 
-	return db, nil
-}
+	// webhook
 
-func (db *DB) CreateCollection(coll *Collection) error {
+	db.createWebhook, err = db.sqlDB.Prepare("insert into webhook (delivery_id, invoice_id, type, payload, status, error, attempts, received, processed) values (?, ?, ?, ?, ?, '', 0, ?, 0)")
+	if err != nil {
+		return nil, err
+	}
 
-	tx, err := db.sqlDB.Begin()
+	db.readWebhook, err = db.sqlDB.Prepare("select id, delivery_id, invoice_id, type, payload, status, error, attempts, received, processed from webhook where id = ? limit 1")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer tx.Rollback() // no effect after commit
 
-	if _, err := tx.Stmt(db.createColl).Exec(coll.ID, coll.Pass, Draft, "{}", "", "", "", "", "", "", "", "", "", "", "", "", "[]", "DE", "", 0, ""); err != nil {
-		return err
+	db.readWebhookByDelivery, err = db.sqlDB.Prepare("select id, delivery_id, invoice_id, type, payload, status, error, attempts, received, processed from webhook where delivery_id = ? limit 1")
+	if err != nil {
+		return nil, err
 	}
 
-	var firstEvent = Event{ // required for the bot which deletes old drafts
-		NewState: Draft,
-		Date:     Today(),
-		Paid:     0,
-		Text:     "Auftragsentwurf wurde angelegt",
+	db.readWebhooks, err = db.sqlDB.Prepare("select id, delivery_id, invoice_id, type, payload, status, error, attempts, received, processed from webhook where status = ? order by id desc")
+	if err != nil {
+		return nil, err
 	}
-	coll.Log = []Event{firstEvent}
 
-	if _, err := tx.Stmt(db.createEvent).Exec(coll.ID, firstEvent.NewState, firstEvent.Date, firstEvent.Paid, firstEvent.Text); err != nil {
-		return err
+	db.updateWebhook, err = db.sqlDB.Prepare("update webhook set status = ?, error = ?, attempts = attempts + 1, processed = ? where id = ?")
+	if err != nil {
+		return nil, err
 	}
-	return tx.Commit()
-}
 
-// CreateEvent creates an event. UpdateCollState should be preferred if the collection state changes.
-func (db *DB) CreateEvent(actor Actor, coll *Collection, paid int, message string) error {
+	db.deleteWebhooks, err = db.sqlDB.Prepare("delete from webhook where invoice_id in (select id from invoice where collid = ?)")
+	if err != nil {
+		return nil, err
+	}
 
-	message = strings.TrimSpace(message)
-	if message != "" {
-		message = fmt.Sprintf("%s: %s", actor.Name(), message)
+	db.pruneWebhooks, err = db.sqlDB.Prepare("delete from webhook where status = ? and processed < ?")
+	if err != nil {
+		return nil, err
 	}
 
-	_, err := db.createEvent.Exec(coll.ID, coll.State, Today(), paid, message)
-	return err
-}
+	// rejected webhook
 
-func (db *DB) Delete(actor Actor, coll *Collection) error {
+	db.createRejectedWebhook, err = db.sqlDB.Prepare("insert into rejected_webhook (received, error, payload) values (?, ?, ?)")
+	if err != nil {
+		return nil, err
+	}
 
-	if !CollFSM.Can(actor, State(coll.State), State(Deleted)) {
-		return errors.New("not allowed to delete collection") // deletion is important, so we must state clearly if it fails (and not just return ErrNotFound)
+	db.readRejectedWebhooks, err = db.sqlDB.Prepare("select id, received, error, payload from rejected_webhook order by id desc limit ?")
+	if err != nil {
+		return nil, err
 	}
 
-	tx, err := db.sqlDB.Begin()
+	db.deleteRejectedWebhooks, err = db.sqlDB.Prepare("delete from rejected_webhook where received < ?")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer tx.Rollback() // no effect after commit
 
-	if _, err := tx.Stmt(db.deleteColl).Exec(coll.ID); err != nil {
-		return err
+	// payment review
+
+	db.createPaymentReview, err = db.sqlDB.Prepare("insert or ignore into payment_review (collid, invoice_id, payment_id, kind, crypto_code, crypto_amount, rate, status, booked_cents, created, history) values (?, ?, ?, ?, ?, ?, ?, ?, 0, ?, '[]')") // ignore payments which are already in the queue
+	if err != nil {
+		return nil, err
 	}
-	if _, err := tx.Stmt(db.deleteEvents).Exec(coll.ID); err != nil {
-		return err
+
+	db.readPaymentReview, err = db.sqlDB.Prepare("select id, collid, invoice_id, payment_id, kind, crypto_code, crypto_amount, rate, status, booked_cents, created, history from payment_review where id = ? limit 1")
+	if err != nil {
+		return nil, err
 	}
-	if _, err := tx.Stmt(db.deleteTasks).Exec(coll.ID); err != nil {
-		return err
+
+	db.readPaymentReviews, err = db.sqlDB.Prepare("select id, collid, invoice_id, payment_id, kind, crypto_code, crypto_amount, rate, status, booked_cents, created, history from payment_review where status = ? order by id")
+	if err != nil {
+		return nil, err
 	}
-	return tx.Commit()
-}
 
-func (db *DB) ReadColl(id string) (*Collection, error) {
+	db.updatePaymentReview, err = db.sqlDB.Prepare("update payment_review set status = ?, booked_cents = ?, history = ? where id = ? and status not in ('booked', 'dismissed')") // resolved reviews are final
+	if err != nil {
+		return nil, err
+	}
 
-	var collData string
-	var deliveryTrackingIDs string // json array
-	var coll = &Collection{ID: id}
-	if err := db.readColl.QueryRow(id).Scan(&coll.Pass, &coll.State, &collData, &coll.ClientContact, &coll.ClientContactProtocol, &coll.DeliveryAddress.FirstName, &coll.DeliveryAddress.LastName, &coll.DeliveryAddress.Supplement, &coll.DeliveryAddress.CustomerID, &coll.DeliveryAddress.Street, &coll.DeliveryAddress.HouseNumber, &coll.DeliveryAddress.Postcode, &coll.DeliveryAddress.City, &coll.DeliveryAddress.Email, &coll.DeliveryAddress.Phone, &deliveryTrackingIDs, &coll.CountryID, &coll.DeliveryMethodID, &coll.DeliveryGrossPrice, &coll.ShippingServiceID); err != nil {
+	db.deletePaymentReviews, err = db.sqlDB.Prepare("delete from payment_review where collid = ?")
+	if err != nil {
 		return nil, err
 	}
 
-	if err := json.Unmarshal([]byte(collData), &coll.CollectionData); err != nil {
+	// invoice
+
+	db.bookInvoice, err = db.sqlDB.Prepare("insert into invoice (id, collid, created, status) values (?, ?, ?, ?) on conflict (id) do update set status = excluded.status where invoice.status != excluded.status") // no change if booked already, invoices from before the invoice table are inserted
+	if err != nil {
 		return nil, err
 	}
 
-	if err := json.Unmarshal([]byte(deliveryTrackingIDs), &coll.DeliveryTrackingIDs); err != nil {
-		return nil, fmt.Errorf("unmarshaling %s: %w", deliveryTrackingIDs, err)
+	db.createInvoice, err = db.sqlDB.Prepare("insert into invoice (id, collid, created, status) values (?, ?, ?, ?)")
+	if err != nil {
+		return nil, err
 	}
 
-	// events
+	db.readInvoiceStatus, err = db.sqlDB.Prepare("select status from invoice where id = ? limit 1")
+	if err != nil {
+		return nil, err
+	}
 
-	events, err := db.readEvents.Query(id)
+	db.readOpenInvoices, err = db.sqlDB.Prepare("select id, collid, created, status from invoice where status = ?")
 	if err != nil {
 		return nil, err
 	}
-	defer events.Close()
 
-	for events.Next() {
-		var event = Event{}
-		if err := events.Scan(&event.NewState, &event.Date, &event.Paid, &event.Text); err != nil {
-			return nil, err
-		}
-		coll.Log = append(coll.Log, event)
+	db.readOpenInvoicesOf, err = db.sqlDB.Prepare("select count(*) from invoice where collid = ? and status = ?")
+	if err != nil {
+		return nil, err
 	}
 
-	// tasks
+	db.updateInvoiceStatus, err = db.sqlDB.Prepare("update invoice set status = ? where id = ?")
+	if err != nil {
+		return nil, err
+	}
 
-	tasks, err := db.readTasks.Query(id)
+	db.deleteInvoices, err = db.sqlDB.Prepare("delete from invoice where collid = ?")
 	if err != nil {
 		return nil, err
 	}
-	defer tasks.Close()
 
-	for tasks.Next() {
-		var taskData string
-		var task = &Task{}
-		if err := tasks.Scan(&task.ID, &task.State, &taskData); err != nil {
-			return nil, err
-		}
-		if err := json.Unmarshal([]byte(taskData), &task.TaskData); err != nil {
-			return nil, err
-		}
-		coll.Tasks = append(coll.Tasks, task)
+	// refund
+
+	db.createRefund, err = db.sqlDB.Prepare("insert into refund (id, collid, cents, claim_link, status, created, booked_cents) values (?, ?, ?, ?, ?, ?, 0)")
+	if err != nil {
+		return nil, err
 	}
 
-	return coll, nil
-}
+	db.readRefunds, err = db.sqlDB.Prepare("select id, collid, cents, claim_link, status, created, booked_cents from refund where collid = ? order by created")
+	if err != nil {
+		return nil, err
+	}
 
-func (db *DB) ReadCollPass(id, pass string) (*Collection, error) {
-	var coll, err = db.ReadColl(id)
+	db.readPendingRefunds, err = db.sqlDB.Prepare("select id, collid, cents, claim_link, status, created, booked_cents from refund where status = ?")
 	if err != nil {
 		return nil, err
 	}
-	if !coll.CompareHash(pass) {
-		return nil, ErrNotFound
+
+	db.readRefundable, err = db.sqlDB.Prepare("select (select coalesce(sum(paid), 0) from event where collid = ?1) - (select coalesce(sum(cents - booked_cents), 0) from refund where collid = ?1 and status = ?2)") // booked parts of refunds are negative payments already
+	if err != nil {
+		return nil, err
 	}
-	return coll, nil
-}
 
-// task count is currently filtered with NotOrderedYet
-func (db *DB) ReadColls(state CollState) ([]string, error) {
-	rows, err := db.readColls.Query(state)
+	db.updateRefundBooking, err = db.sqlDB.Prepare("update refund set status = ?, booked_cents = ? where id = ? and booked_cents = ?") // fails if the refund has been booked in the meantime
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	var ids []string
-	for rows.Next() {
-		var id string
-		if err := rows.Scan(&id); err != nil {
-			return nil, err
-		}
-		ids = append(ids, id)
+
+	db.deleteRefunds, err = db.sqlDB.Prepare("delete from refund where collid = ?")
+	if err != nil {
+		return nil, err
 	}
-	return ids, nil
-}
 
-func (db *DB) ReadState(id string) (CollState, error) {
-	var state string
-	return CollState(state), db.readState.QueryRow(id).Scan(&state)
-}
+	// job
 
-// coll must contain the old state
-func (db *DB) UpdateCollState(actor Actor, coll *Collection, newState CollState, paidAmount int, message string) error {
+	db.createJob, err = db.sqlDB.Prepare("insert into job (kind, collid, run_at, attempts, last_error, failed, generation) values (?, ?, ?, 0, '', 0, 0) on conflict (kind, collid) where failed = 0 do update set run_at = min(run_at, excluded.run_at), generation = generation + 1")
+	if err != nil {
+		return nil, err
+	}
 
-	if !CollFSM.Can(actor, State(coll.State), State(newState)) {
-		return ErrNotFound
+	db.readJob, err = db.sqlDB.Prepare("select id, kind, collid, run_at, attempts, last_error, failed, generation from job where id = ? limit 1")
+	if err != nil {
+		return nil, err
 	}
 
-	message = strings.TrimSpace(message)
-	if message != "" {
-		message = fmt.Sprintf("%s: %s", actor.Name(), message)
+	db.readNextJob, err = db.sqlDB.Prepare("select id, kind, collid, run_at, attempts, last_error, failed, generation from job where failed = 0 and run_at <= ? order by run_at limit 1")
+	if err != nil {
+		return nil, err
 	}
 
-	tx, err := db.sqlDB.Begin()
+	db.readFailedJobs, err = db.sqlDB.Prepare("select id, kind, collid, run_at, attempts, last_error, failed, generation from job where failed = 1 or attempts > 0 order by id")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer tx.Rollback() // no effect after commit
 
-	if _, err := tx.Stmt(db.updateCollState).Exec(newState, coll.ID); err != nil {
-		return err
+	db.updateJob, err = db.sqlDB.Prepare("update job set run_at = ?, attempts = ?, last_error = ?, failed = ? where id = ? and generation = ?") // no change if the job has been requested again
+	if err != nil {
+		return nil, err
 	}
 
-	if _, err := tx.Stmt(db.createEvent).Exec(coll.ID, newState, Today(), paidAmount, message); err != nil {
-		return err
+	db.requeueJob, err = db.sqlDB.Prepare("update job set run_at = min(run_at, ?), attempts = 0, last_error = '', failed = 0 where id = ?")
+	if err != nil {
+		return nil, err
 	}
 
-	if err := tx.Commit(); err != nil {
-		return err
+	db.deleteJob, err = db.sqlDB.Prepare("delete from job where id = ? and generation = ?") // no change if the job has been requested again
+	if err != nil {
+		return nil, err
 	}
 
-	coll.State = newState
-	return nil
-}
+	// notification
 
-// updates the collection given by coll.ID
-func (db *DB) UpdateCollAndTasks(coll *Collection) error {
+	db.createNotification, err = db.sqlDB.Prepare("insert into notification (collid, kind, collstate, status, attempts, last_error, created, sent) values (?, ?, ?, ?, 0, '', ?, '')")
+	if err != nil {
+		return nil, err
+	}
 
-	data, err := json.Marshal(coll.CollectionData)
+	db.readNotifications, err = db.sqlDB.Prepare("select id, collid, kind, collstate, status, attempts, last_error, created, sent from notification where collid = ? order by id")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	deliveryTrackingIDs, err := json.Marshal(coll.DeliveryTrackingIDs)
+
+	db.readPendingNotified, err = db.sqlDB.Prepare("select distinct collid from notification where status = ?")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	tx, err := db.sqlDB.Begin()
+	db.updateNotification, err = db.sqlDB.Prepare("update notification set status = ?, attempts = ?, last_error = ?, sent = ? where id = ?")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer tx.Rollback() // no effect after commit
 
-	if _, err := tx.Stmt(db.updateColl).Exec(string(data), coll.ClientContact, coll.ClientContactProtocol, coll.DeliveryAddress.FirstName, coll.DeliveryAddress.LastName, coll.DeliveryAddress.Supplement, coll.DeliveryAddress.CustomerID, coll.DeliveryAddress.Street, coll.DeliveryAddress.HouseNumber, coll.DeliveryAddress.Postcode, coll.DeliveryAddress.City, coll.DeliveryAddress.Email, coll.DeliveryAddress.Phone, deliveryTrackingIDs, coll.CountryID, coll.DeliveryMethodID, coll.DeliveryGrossPrice, coll.ShippingServiceID, coll.ID); err != nil {
-		return err
+	db.deleteNotifications, err = db.sqlDB.Prepare("delete from notification where collid = ?")
+	if err != nil {
+		return nil, err
 	}
 
-	if _, err := tx.Stmt(db.deleteTasks).Exec(coll.ID); err != nil {
-		return err
+	// feed
+
+	db.createFeedToken, err = db.sqlDB.Prepare("insert into feed_token (token, collid) values (?, ?)")
+	if err != nil {
+		return nil, err
 	}
 
-	for _, task := range coll.Tasks {
-		if task.State == "" {
-			task.State = NotOrderedYet // initial state
-		}
-		taskData, err := json.Marshal(task.TaskData)
+	db.readFeedToken, err = db.sqlDB.Prepare("select token from feed_token where collid = ? limit 1")
+	if err != nil {
+		return nil, err
+	}
+
+	db.readFeedCollID, err = db.sqlDB.Prepare("select collid from feed_token where token = ? limit 1")
+	if err != nil {
+		return nil, err
+	}
+
+	db.deleteFeedTokens, err = db.sqlDB.Prepare("delete from feed_token where collid = ?")
+	if err != nil {
+		return nil, err
+	}
+
+	// staff
+
+	db.createStaffEvent, err = db.sqlDB.Prepare("insert into staff_event (kind, collid, created) values (?, ?, ?)")
+	if err != nil {
+		return nil, err
+	}
+
+	db.readStaffEvents, err = db.sqlDB.Prepare("select id, kind, collid, created from staff_event where id > ? order by id desc limit ?")
+	if err != nil {
+		return nil, err
+	}
+
+	db.deleteStaffEvents, err = db.sqlDB.Prepare("delete from staff_event where created < ?")
+	if err != nil {
+		return nil, err
+	}
+
+	db.deleteCollStaffEvents, err = db.sqlDB.Prepare("delete from staff_event where collid = ?")
+	if err != nil {
+		return nil, err
+	}
+
+	db.readStaffSettings, err = db.sqlDB.Prepare("select data from staff_settings where username = ? limit 1")
+	if err != nil {
+		return nil, err
+	}
+
+	db.readAllStaffSettings, err = db.sqlDB.Prepare("select username, data from staff_settings")
+	if err != nil {
+		return nil, err
+	}
+
+	db.updateStaffSettings, err = db.sqlDB.Prepare("insert into staff_settings (username, data) values (?, ?) on conflict (username) do update set data = excluded.data")
+	if err != nil {
+		return nil, err
+	}
+
+	// totp
+
+	db.readTOTP, err = db.sqlDB.Prepare("select secret, confirmed, last_step, recovery from totp where username = ? limit 1")
+	if err != nil {
+		return nil, err
+	}
+
+	db.updateTOTP, err = db.sqlDB.Prepare("insert into totp (username, secret, confirmed, last_step, recovery) values (?, ?, ?, ?, ?) on conflict (username) do update set secret = excluded.secret, confirmed = excluded.confirmed, last_step = excluded.last_step, recovery = excluded.recovery")
+	if err != nil {
+		return nil, err
+	}
+
+	db.deleteTOTP, err = db.sqlDB.Prepare("delete from totp where username = ?")
+	if err != nil {
+		return nil, err
+	}
+
+	// login attempts
+
+	db.readLoginAttempt, err = db.sqlDB.Prepare("select failures, last_failure, locked_until from login_attempt where key = ? limit 1")
+	if err != nil {
+		return nil, err
+	}
+
+	db.readLoginAttempts, err = db.sqlDB.Prepare("select key, failures, last_failure, locked_until from login_attempt order by last_failure desc")
+	if err != nil {
+		return nil, err
+	}
+
+	// one statement, so concurrent failures are all counted
+	db.failLoginAttempt, err = db.sqlDB.Prepare("insert into login_attempt (key, failures, last_failure, locked_until) values (?, 1, ?, 0) on conflict (key) do update set failures = case when excluded.last_failure - last_failure > ? then 1 else failures + 1 end, last_failure = excluded.last_failure returning failures")
+	if err != nil {
+		return nil, err
+	}
+
+	db.lockLoginAttempt, err = db.sqlDB.Prepare("update login_attempt set locked_until = max(locked_until, ?) where key = ?")
+	if err != nil {
+		return nil, err
+	}
+
+	db.deleteLoginAttempt, err = db.sqlDB.Prepare("delete from login_attempt where key = ?")
+	if err != nil {
+		return nil, err
+	}
+
+	db.pruneLoginAttempts, err = db.sqlDB.Prepare("delete from login_attempt where last_failure < ? and locked_until < ?")
+	if err != nil {
+		return nil, err
+	}
+
+	// sessions
+
+	db.createSession, err = db.sqlDB.Prepare("insert into session (id, kind, subject, created, last_seen) values (?, ?, ?, ?, ?)")
+	if err != nil {
+		return nil, err
+	}
+
+	db.readSession, err = db.sqlDB.Prepare("select kind, subject, created, last_seen from session where id = ? limit 1")
+	if err != nil {
+		return nil, err
+	}
+
+	db.readSessions, err = db.sqlDB.Prepare("select id, kind, subject, created, last_seen from session order by kind, subject, last_seen desc")
+	if err != nil {
+		return nil, err
+	}
+
+	db.readSubjectSessions, err = db.sqlDB.Prepare("select id, kind, subject, created, last_seen from session where kind = ? and subject = ? order by last_seen desc")
+	if err != nil {
+		return nil, err
+	}
+
+	db.updateSessionSeen, err = db.sqlDB.Prepare("update session set last_seen = ? where id = ?")
+	if err != nil {
+		return nil, err
+	}
+
+	db.deleteSession, err = db.sqlDB.Prepare("delete from session where id = ?")
+	if err != nil {
+		return nil, err
+	}
+
+	db.deleteOtherSessions, err = db.sqlDB.Prepare("delete from session where kind = ? and subject = ? and id != ?")
+	if err != nil {
+		return nil, err
+	}
+
+	db.deleteIdleSessions, err = db.sqlDB.Prepare("delete from session where last_seen < ?")
+	if err != nil {
+		return nil, err
+	}
+
+	db.deleteCollSessions, err = db.sqlDB.Prepare("delete from session where kind = ? and subject = ?")
+	if err != nil {
+		return nil, err
+	}
+
+	// audit
+
+	db.createAuditEntry, err = db.sqlDB.Prepare("insert into audit (time, username, action, target) values (?, ?, ?, ?)")
+	if err != nil {
+		return nil, err
+	}
+
+	db.readAuditEntries, err = db.sqlDB.Prepare("select id, time, username, action, target from audit where (? = '' or username = ?) and instr(action, ?) > 0 and instr(target, ?) > 0 and time >= ? and time < ? order by id desc limit ?")
+	if err != nil {
+		return nil, err
+	}
+
+	db.deleteAuditEntries, err = db.sqlDB.Prepare("delete from audit where time < ?")
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// CreateCollection creates a draft with default data and the tasks of coll, e.g. copied from a previous collection.
+func (db *DB) CreateCollection(coll *Collection) error {
+
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no effect after commit
+
+	if _, err := tx.Stmt(db.createColl).Exec(coll.ID, coll.Pass, Draft, "{}", "", "", "", "", "", "", "", "", "", "", "", "", "[]", "DE", "", 0, ""); err != nil {
+		return err
+	}
+
+	var firstEvent = Event{ // required for the bot which deletes old drafts
+		NewState: Draft,
+		Date:     Today(),
+		Paid:     0,
+		Text:     "Auftragsentwurf wurde angelegt",
+	}
+	coll.Log = []Event{firstEvent}
+
+	if _, err := tx.Stmt(db.createEvent).Exec(coll.ID, firstEvent.NewState, firstEvent.Date, firstEvent.Paid, firstEvent.Text); err != nil {
+		return err
+	}
+	if err := db.createTasksTx(tx, coll); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateEvent creates an event. UpdateCollState should be preferred if the collection state changes.
+func (db *DB) CreateEvent(actor Actor, coll *Collection, paid int, message string) error {
+	return db.CreateEventWithAttachments(actor, coll, paid, message, nil)
+}
+
+// CreateEventWithAttachments creates an event and stores the given files as its attachments.
+func (db *DB) CreateEventWithAttachments(actor Actor, coll *Collection, paid int, message string, files []*AttachmentFile) error {
+
+	message = strings.TrimSpace(message)
+	if message == "" && len(files) > 0 {
+		message = "Anhang"
+	}
+
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no effect after commit
+
+	result, err := db.createEventTx(tx, actor, coll, paid, message)
+	if err != nil {
+		return err
+	}
+
+	var written []string // files are removed if the transaction fails
+	var committed = false
+	defer func() {
+		if !committed {
+			for _, path := range written {
+				os.Remove(path)
+			}
+		}
+	}()
+	if len(files) > 0 {
+		eventID, err := result.LastInsertId()
 		if err != nil {
 			return err
 		}
-		if _, err := tx.Stmt(db.createTask).Exec(task.ID, coll.ID, task.State, string(taskData)); err != nil {
+		var dir = filepath.Join(db.attachmentDir, coll.ID)
+		if err := os.MkdirAll(dir, 0700); err != nil {
 			return err
 		}
+		for _, file := range files {
+			var attachmentID = id.New(16, id.AlphanumCaseSensitiveDigits)
+			if _, err := tx.Stmt(db.createAttachment).Exec(attachmentID, coll.ID, eventID, file.Name, file.Type, len(file.Data)); err != nil {
+				return err
+			}
+			var path = filepath.Join(dir, attachmentID)
+			if err := os.WriteFile(path, file.Data, 0600); err != nil {
+				return err
+			}
+			written = append(written, path)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// createEventTx creates an event without state change. A message is prefixed with the actor name and notified.
+func (db *DB) createEventTx(tx *sql.Tx, actor Actor, coll *Collection, paid int, message string) (sql.Result, error) {
+	message = strings.TrimSpace(message)
+	if message != "" {
+		message = fmt.Sprintf("%s: %s", actor.Name(), message)
+	}
+	result, err := tx.Stmt(db.createEvent).Exec(coll.ID, coll.State, Today(), paid, message)
+	if err != nil {
+		return nil, err
+	}
+	if message != "" {
+		if err := db.notifyTx(tx, actor, coll, NotifyMessage, coll.State); err != nil {
+			return nil, err
+		}
+		if actor == Client {
+			if err := db.staffEventTx(tx, StaffClientMessage, coll.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// UpdateCollAssignee sets the store user who has claimed the collection. An empty username releases it. Claims are internal, so no event is logged.
+func (db *DB) UpdateCollAssignee(coll *Collection, username string) error {
+	coll.Assignee = username
+	data, err := json.Marshal(coll.CollectionData)
+	if err != nil {
+		return err
+	}
+	_, err = db.updateCollData.Exec(string(data), coll.ID)
+	return err
+}
+
+// UpdateCollPass stores the passphrase and the collection data, which contains the reset code, and logs the change.
+func (db *DB) UpdateCollPass(actor Actor, coll *Collection, message string) error {
+
+	data, err := json.Marshal(coll.CollectionData)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback() // no effect after commit
 
+	if _, err := tx.Stmt(db.updateCollPass).Exec(coll.Pass, string(data), coll.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(db.createEvent).Exec(coll.ID, coll.State, Today(), 0, fmt.Sprintf("%s: %s", actor.Name(), message)); err != nil {
+		return err
+	}
+	if err := db.notifyTx(tx, actor, coll, NotifyMessage, coll.State); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
-// task must contain the old state
-func (db *DB) UpdateTaskState(actor Actor, task *Task, newState TaskState) error {
-	if !TaskFSM.Can(actor, State(task.State), State(newState)) {
-		return ErrNotFound
+func (db *DB) Delete(actor Actor, coll *Collection) error {
+
+	if !CollFSM.Can(actor, State(coll.State), State(Deleted)) {
+		return errors.New("not allowed to delete collection") // deletion is important, so we must state clearly if it fails (and not just return ErrNotFound)
 	}
-	if _, err := db.updateTaskState.Exec(newState, task.ID); err != nil {
+
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
 		return err
 	}
-	task.State = newState
-	return nil
+	defer tx.Rollback() // no effect after commit
+
+	if _, err := tx.Stmt(db.deleteColl).Exec(coll.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(db.deleteEvents).Exec(coll.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(db.deleteTasks).Exec(coll.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(db.deleteNotifications).Exec(coll.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(db.deleteFeedTokens).Exec(coll.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(db.deleteAttachments).Exec(coll.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(db.deleteWebhooks).Exec(coll.ID); err != nil { // before the invoices, the payloads contain the collection ID
+		return err
+	}
+	if _, err := tx.Stmt(db.deleteInvoices).Exec(coll.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(db.deletePaymentReviews).Exec(coll.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(db.deleteRefunds).Exec(coll.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(db.deleteCollStaffEvents).Exec(coll.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(db.deleteCollSessions).Exec(ClientSession, coll.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(db.attachmentDir, coll.ID))
+}
+
+func (db *DB) ReadColl(id string) (*Collection, error) {
+
+	var collData string
+	var deliveryTrackingIDs string // json array
+	var coll = &Collection{ID: id}
+	if err := db.readColl.QueryRow(id).Scan(&coll.Pass, &coll.State, &collData, &coll.ClientContact, &coll.ClientContactProtocol, &coll.DeliveryAddress.FirstName, &coll.DeliveryAddress.LastName, &coll.DeliveryAddress.Supplement, &coll.DeliveryAddress.CustomerID, &coll.DeliveryAddress.Street, &coll.DeliveryAddress.HouseNumber, &coll.DeliveryAddress.Postcode, &coll.DeliveryAddress.City, &coll.DeliveryAddress.Email, &coll.DeliveryAddress.Phone, &deliveryTrackingIDs, &coll.CountryID, &coll.DeliveryMethodID, &coll.DeliveryGrossPrice, &coll.ShippingServiceID); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(collData), &coll.CollectionData); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(deliveryTrackingIDs), &coll.DeliveryTrackingIDs); err != nil {
+		return nil, fmt.Errorf("unmarshaling %s: %w", deliveryTrackingIDs, err)
+	}
+
+	// events
+
+	events, err := db.readEvents.Query(id)
+	if err != nil {
+		return nil, err
+	}
+	defer events.Close()
+
+	for events.Next() {
+		var event = Event{}
+		if err := events.Scan(&event.ID, &event.NewState, &event.Date, &event.Paid, &event.Text); err != nil {
+			return nil, err
+		}
+		coll.Log = append(coll.Log, event)
+	}
+
+	// attachments
+
+	attachments, err := db.readAttachments.Query(id)
+	if err != nil {
+		return nil, err
+	}
+	defer attachments.Close()
+
+	for attachments.Next() {
+		var attachment = &Attachment{CollID: id}
+		if err := attachments.Scan(&attachment.ID, &attachment.EventID, &attachment.Name, &attachment.Type, &attachment.Size); err != nil {
+			return nil, err
+		}
+		for i := range coll.Log {
+			if coll.Log[i].ID == attachment.EventID {
+				coll.Log[i].Attachments = append(coll.Log[i].Attachments, attachment)
+			}
+		}
+	}
+
+	// tasks
+
+	tasks, err := db.readTasks.Query(id)
+	if err != nil {
+		return nil, err
+	}
+	defer tasks.Close()
+
+	for tasks.Next() {
+		var taskData string
+		var task = &Task{}
+		if err := tasks.Scan(&task.ID, &task.State, &taskData); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(taskData), &task.TaskData); err != nil {
+			return nil, err
+		}
+		coll.Tasks = append(coll.Tasks, task)
+	}
+
+	return coll, nil
+}
+
+func (db *DB) ReadCollPass(id, pass string) (*Collection, error) {
+	var coll, err = db.ReadColl(id)
+	if err != nil {
+		return nil, err
+	}
+	if !coll.CompareHash(pass) {
+		return nil, ErrNotFound
+	}
+	return coll, nil
+}
+
+// task count is currently filtered with NotOrderedYet
+func (db *DB) ReadColls(state CollState) ([]string, error) {
+	rows, err := db.readColls.Query(state)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (db *DB) ReadState(id string) (CollState, error) {
+	var state string
+	return CollState(state), db.readState.QueryRow(id).Scan(&state)
+}
+
+// coll must contain the old state
+func (db *DB) UpdateCollState(actor Actor, coll *Collection, newState CollState, paidAmount int, message string) error {
+
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no effect after commit
+
+	if err := db.updateCollStateTx(tx, actor, coll, newState, paidAmount, message); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	coll.State = newState
+	return nil
+}
+
+// updateCollStateTx does not modify coll.State, so the caller can do it after the transaction has been committed.
+func (db *DB) updateCollStateTx(tx *sql.Tx, actor Actor, coll *Collection, newState CollState, paidAmount int, message string) error {
+
+	if !CollFSM.Can(actor, State(coll.State), State(newState)) {
+		return ErrNotFound
+	}
+
+	message = strings.TrimSpace(message)
+	if message != "" {
+		message = fmt.Sprintf("%s: %s", actor.Name(), message)
+	}
+
+	if _, err := tx.Stmt(db.updateCollState).Exec(newState, coll.ID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Stmt(db.createEvent).Exec(coll.ID, newState, Today(), paidAmount, message); err != nil {
+		return err
+	}
+
+	if err := db.staffEventOnStateTx(tx, actor, coll, newState, paidAmount, message); err != nil {
+		return err
+	}
+
+	var kind = NotifyState
+	if newState == coll.State {
+		if message == "" {
+			return nil
+		}
+		kind = NotifyMessage
+	}
+	return db.notifyTx(tx, actor, coll, kind, newState)
+}
+
+// staffEventOnStateTx adds a staff event about a state change. Staff is not notified about their own actions.
+// A message which comes with a state change is not reported separately.
+func (db *DB) staffEventOnStateTx(tx *sql.Tx, actor Actor, coll *Collection, newState CollState, paidAmount int, message string) error {
+	var kind StaffEventKind
+	switch {
+	case actor == Store:
+		return nil
+	case newState != coll.State && newState == Submitted:
+		kind = StaffSubmitted
+	case newState != coll.State && newState == Cancelled:
+		kind = StaffCancelled
+	case paidAmount > 0:
+		kind = StaffPaid
+	case actor == Client && message != "":
+		kind = StaffClientMessage
+	default:
+		return nil
+	}
+	return db.staffEventTx(tx, kind, coll.ID)
+}
+
+func (db *DB) staffEventTx(tx *sql.Tx, kind StaffEventKind, collID string) error {
+	_, err := tx.Stmt(db.createStaffEvent).Exec(kind, collID, Today())
+	return err
+}
+
+// notifyTx adds a notification to the send log and schedules a job which sends it. The client is not notified about their own actions.
+func (db *DB) notifyTx(tx *sql.Tx, actor Actor, coll *Collection, kind NotificationKind, state CollState) error {
+	if actor == Client || !coll.WantsNotifications() {
+		return nil
+	}
+	if _, err := tx.Stmt(db.createNotification).Exec(coll.ID, kind, state, NotificationPending, Today()); err != nil {
+		return err
+	}
+	_, err := tx.Stmt(db.createJob).Exec(JobNotify, coll.ID, time.Now().Unix())
+	return err
+}
+
+// UpdateCollAndTasksWithEvent updates the collection and creates an event in one transaction, so a price change and its approval message can't get out of sync.
+func (db *DB) UpdateCollAndTasksWithEvent(actor Actor, coll *Collection, message string) error {
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no effect after commit
+
+	if err := db.updateCollAndTasksTx(tx, coll); err != nil {
+		return err
+	}
+	if _, err := db.createEventTx(tx, actor, coll, 0, message); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updates the collection given by coll.ID
+func (db *DB) UpdateCollAndTasks(coll *Collection) error {
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no effect after commit
+
+	if err := db.updateCollAndTasksTx(tx, coll); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) updateCollAndTasksTx(tx *sql.Tx, coll *Collection) error {
+
+	data, err := json.Marshal(coll.CollectionData)
+	if err != nil {
+		return err
+	}
+	deliveryTrackingIDs, err := json.Marshal(coll.DeliveryTrackingIDs)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Stmt(db.updateColl).Exec(string(data), coll.ClientContact, coll.ClientContactProtocol, coll.DeliveryAddress.FirstName, coll.DeliveryAddress.LastName, coll.DeliveryAddress.Supplement, coll.DeliveryAddress.CustomerID, coll.DeliveryAddress.Street, coll.DeliveryAddress.HouseNumber, coll.DeliveryAddress.Postcode, coll.DeliveryAddress.City, coll.DeliveryAddress.Email, coll.DeliveryAddress.Phone, deliveryTrackingIDs, coll.CountryID, coll.DeliveryMethodID, coll.DeliveryGrossPrice, coll.ShippingServiceID, coll.ID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Stmt(db.deleteTasks).Exec(coll.ID); err != nil {
+		return err
+	}
+	return db.createTasksTx(tx, coll)
+}
+
+func (db *DB) createTasksTx(tx *sql.Tx, coll *Collection) error {
+	for _, task := range coll.Tasks {
+		if task.State == "" {
+			task.State = NotOrderedYet // initial state
+		}
+		taskData, err := json.Marshal(task.TaskData)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Stmt(db.createTask).Exec(task.ID, coll.ID, task.State, string(taskData)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// task must contain the old state
+func (db *DB) UpdateTaskState(actor Actor, task *Task, newState TaskState) error {
+	if !TaskFSM.Can(actor, State(task.State), State(newState)) {
+		return ErrNotFound
+	}
+	if _, err := db.updateTaskState.Exec(newState, task.ID); err != nil {
+		return err
+	}
+	task.State = newState
+	return nil
+}
+
+// CreateWebhook stores an incoming webhook. If a webhook with the same delivery ID exists, it is returned instead.
+func (db *DB) CreateWebhook(deliveryID, invoiceID, eventType, payload string) (*Webhook, error) {
+	if wh, err := db.ReadWebhookByDelivery(deliveryID); err == nil {
+		return wh, nil
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+	if _, err := db.createWebhook.Exec(deliveryID, invoiceID, eventType, payload, WebhookPending, time.Now().Unix()); err != nil {
+		return nil, err
+	}
+	return db.ReadWebhookByDelivery(deliveryID)
+}
+
+func (db *DB) ReadWebhook(id int) (*Webhook, error) {
+	return scanWebhook(db.readWebhook.QueryRow(id))
+}
+
+func (db *DB) ReadWebhookByDelivery(deliveryID string) (*Webhook, error) {
+	return scanWebhook(db.readWebhookByDelivery.QueryRow(deliveryID))
+}
+
+func (db *DB) ReadWebhooks(status WebhookStatus) ([]*Webhook, error) {
+	rows, err := db.readWebhooks.Query(status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var webhooks []*Webhook
+	for rows.Next() {
+		wh, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, wh)
+	}
+	return webhooks, rows.Err()
+}
+
+// UpdateWebhook records the result of a processing attempt.
+func (db *DB) UpdateWebhook(wh *Webhook, processErr error) error {
+	wh.Attempts++
+	wh.Processed = time.Now()
+	if processErr == nil {
+		wh.Status = WebhookProcessed
+		wh.Error = ""
+	} else {
+		wh.Status = WebhookFailed
+		wh.Error = processErr.Error()
+	}
+	_, err := db.updateWebhook.Exec(wh.Status, wh.Error, wh.Processed.Unix(), wh.ID)
+	return err
+}
+
+// CreateRejectedWebhook stores a delivery whose signature or store ID is wrong. It is kept apart from the inbox, because its delivery ID can't be trusted.
+func (db *DB) CreateRejectedWebhook(received time.Time, rejectErr error, payload string) error {
+	_, err := db.createRejectedWebhook.Exec(received.Unix(), rejectErr.Error(), payload)
+	return err
+}
+
+// ReadRejectedWebhooks returns the latest rejected deliveries.
+func (db *DB) ReadRejectedWebhooks(limit int) ([]*RejectedWebhook, error) {
+	rows, err := db.readRejectedWebhooks.Query(limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var webhooks []*RejectedWebhook
+	for rows.Next() {
+		var wh = &RejectedWebhook{}
+		var received int64
+		if err := rows.Scan(&wh.ID, &received, &wh.Error, &wh.Payload); err != nil {
+			return nil, err
+		}
+		wh.Received = time.Unix(received, 0)
+		webhooks = append(webhooks, wh)
+	}
+	return webhooks, rows.Err()
+}
+
+// PruneWebhooks deletes processed webhooks from the inbox.
+func (db *DB) PruneWebhooks(before time.Time) error {
+	_, err := db.pruneWebhooks.Exec(WebhookProcessed, before.Unix())
+	return err
+}
+
+func (db *DB) DeleteRejectedWebhooks(before time.Time) error {
+	_, err := db.deleteRejectedWebhooks.Exec(before.Unix())
+	return err
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanWebhook(row scanner) (*Webhook, error) {
+	var wh = &Webhook{}
+	var received, processed int64
+	if err := row.Scan(&wh.ID, &wh.DeliveryID, &wh.InvoiceID, &wh.Type, &wh.Payload, &wh.Status, &wh.Error, &wh.Attempts, &received, &processed); err != nil {
+		return nil, err
+	}
+	wh.Received = time.Unix(received, 0)
+	if processed != 0 {
+		wh.Processed = time.Unix(processed, 0)
+	}
+	return wh, nil
+}
+
+// CreatePaymentReview adds a payment to the review queue. If the payment is in the queue already, nothing happens and false is returned.
+func (db *DB) CreatePaymentReview(review *PaymentReview) (bool, error) {
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() // no effect after commit
+
+	created, err := db.createPaymentReviewTx(tx, review)
+	if err != nil {
+		return false, err
+	}
+	return created, tx.Commit()
+}
+
+func (db *DB) createPaymentReviewTx(tx *sql.Tx, review *PaymentReview) (bool, error) {
+	result, err := tx.Stmt(db.createPaymentReview).Exec(review.CollID, review.InvoiceID, review.PaymentID, review.Kind, review.CryptoCode, review.CryptoAmount, review.Rate, ReviewOpen, Today())
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 { // ignored
+		return false, err
+	}
+	return true, db.staffEventTx(tx, StaffLatePayment, review.CollID)
+}
+
+// ReceivePayments saves the received payment IDs of the collection, adds the late payments to the review queue and writes the bot messages in one transaction.
+// Else a redelivered webhook would skip a payment which has been marked as received, but not queued.
+func (db *DB) ReceivePayments(coll *Collection, reviews []*PaymentReview, messages []string) error {
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no effect after commit
+
+	if err := db.updateCollAndTasksTx(tx, coll); err != nil {
+		return err
+	}
+	for _, review := range reviews {
+		if _, err := db.createPaymentReviewTx(tx, review); err != nil {
+			return err
+		}
+	}
+	for _, message := range messages {
+		if _, err := db.createEventTx(tx, Bot, coll, 0, message); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *DB) ReadPaymentReview(id int) (*PaymentReview, error) {
+	return scanPaymentReview(db.readPaymentReview.QueryRow(id))
+}
+
+func (db *DB) ReadPaymentReviews(status ReviewStatus) ([]*PaymentReview, error) {
+	rows, err := db.readPaymentReviews.Query(status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var reviews []*PaymentReview
+	for rows.Next() {
+		review, err := scanPaymentReview(rows)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, review)
+	}
+	return reviews, rows.Err()
+}
+
+// UpdatePaymentReview sets the status of a payment review and appends an entry to its history.
+// If the new status is ReviewBooked, the given amount is booked as a payment to the collection with the given message, and the collection becomes Active.
+func (db *DB) UpdatePaymentReview(username string, review *PaymentReview, coll *Collection, status ReviewStatus, cents int, note, message string) error {
+
+	if review.Status.Resolved() {
+		return ErrReviewResolved
+	}
+	if review.CollID != coll.ID {
+		return errors.New("payment review does not belong to collection")
+	}
+
+	var history = append(review.History, ReviewHistoryEntry{
+		Date:     Today(),
+		Username: username,
+		Status:   status,
+		Cents:    cents,
+		Note:     strings.TrimSpace(note),
+	})
+	historyData, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no effect after commit
+
+	var bookedCents = 0
+	if status == ReviewBooked {
+		bookedCents = cents
+	}
+
+	// update the review first, so a concurrent request which has resolved it already can't book the payment twice
+	result, err := tx.Stmt(db.updatePaymentReview).Exec(status, bookedCents, string(historyData), review.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrReviewResolved
+	}
+
+	if status == ReviewBooked {
+		if err := db.updateCollStateTx(tx, Store, coll, Active, cents, message); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if status == ReviewBooked {
+		coll.State = Active
+	}
+	review.Status = status
+	review.BookedCents = bookedCents
+	review.History = history
+	return nil
+}
+
+func scanPaymentReview(row scanner) (*PaymentReview, error) {
+	var review = &PaymentReview{}
+	var history string
+	if err := row.Scan(&review.ID, &review.CollID, &review.InvoiceID, &review.PaymentID, &review.Kind, &review.CryptoCode, &review.CryptoAmount, &review.Rate, &review.Status, &review.BookedCents, &review.Created, &history); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(history), &review.History); err != nil {
+		return nil, err
+	}
+	return review, nil
+}
+
+// BookInvoice marks the invoice as booked and books the paid amount to the collection, which becomes Active, in one transaction.
+// If the invoice has been booked already, it returns ErrInvoiceBooked and books nothing.
+func (db *DB) BookInvoice(invoiceID string, coll *Collection, paidAmount int, message string) error {
+
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no effect after commit
+
+	result, err := tx.Stmt(db.bookInvoice).Exec(invoiceID, coll.ID, Today(), InvoiceBooked)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrInvoiceBooked
+	}
+
+	if err := db.updateCollStateTx(tx, Bot, coll, Active, paidAmount, message); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	coll.State = Active
+	return nil
+}
+
+// InvoiceBooked returns whether the invoice has been booked. Invoices which have been booked before the invoice table existed are only recorded in the collection data.
+func (db *DB) InvoiceBooked(coll *Collection, invoiceID string) (bool, error) {
+	if coll.InvoiceHasBeenBooked(invoiceID) {
+		return true, nil
+	}
+	var status InvoiceStatus
+	err := db.readInvoiceStatus.QueryRow(invoiceID).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return status == InvoiceBooked, err
+}
+
+func (db *DB) CreateInvoice(invoiceID, collID string) error {
+	_, err := db.createInvoice.Exec(invoiceID, collID, Today(), InvoiceOpen)
+	return err
+}
+
+func (db *DB) ReadOpenInvoices() ([]*Invoice, error) {
+	rows, err := db.readOpenInvoices.Query(InvoiceOpen)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var invoices []*Invoice
+	for rows.Next() {
+		var invoice = &Invoice{}
+		if err := rows.Scan(&invoice.ID, &invoice.CollID, &invoice.Created, &invoice.Status); err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, invoice)
+	}
+	return invoices, rows.Err()
+}
+
+// HasOpenInvoices returns whether the collection has invoices which BTCPay still monitors, so a payment can arrive.
+func (db *DB) HasOpenInvoices(collID string) (bool, error) {
+	var n int
+	err := db.readOpenInvoicesOf.QueryRow(collID, InvoiceOpen).Scan(&n)
+	return n > 0, err
+}
+
+func (db *DB) UpdateInvoiceStatus(invoice *Invoice, status InvoiceStatus) error {
+	if _, err := db.updateInvoiceStatus.Exec(status, invoice.ID); err != nil {
+		return err
+	}
+	invoice.Status = status
+	return nil
+}
+
+// CreateRefund stores a refund and adds an event with the given message to the collection log.
+// If the refund exceeds the refundable amount, which may have changed since the caller has checked it, it returns ErrRefundExceeded.
+func (db *DB) CreateRefund(refund *Refund, coll *Collection, message string) error {
+
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no effect after commit
+
+	refund.CollID = coll.ID
+	refund.Created = Today()
+	refund.Status = RefundPending
+
+	// insert first, so a concurrent refund has to wait for the write lock, then check the refundable amount including this refund
+	if _, err := tx.Stmt(db.createRefund).Exec(refund.ID, refund.CollID, refund.Cents, refund.ClaimLink, refund.Status, refund.Created); err != nil {
+		return err
+	}
+	var refundable int
+	if err := tx.Stmt(db.readRefundable).QueryRow(coll.ID, RefundPending).Scan(&refundable); err != nil {
+		return err
+	}
+	if refundable < 0 {
+		return ErrRefundExceeded
+	}
+	if _, err := tx.Stmt(db.createEvent).Exec(coll.ID, coll.State, Today(), 0, fmt.Sprintf("%s: %s", Store.Name(), message)); err != nil {
+		return err
+	}
+	if err := db.notifyTx(tx, Store, coll, NotifyMessage, coll.State); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReadRefunds returns the refunds of a collection.
+func (db *DB) ReadRefunds(collID string) ([]*Refund, error) {
+	rows, err := db.readRefunds.Query(collID)
+	if err != nil {
+		return nil, err
+	}
+	return scanRefunds(rows)
+}
+
+func (db *DB) ReadPendingRefunds() ([]*Refund, error) {
+	rows, err := db.readPendingRefunds.Query(RefundPending)
+	if err != nil {
+		return nil, err
+	}
+	return scanRefunds(rows)
+}
+
+// BookRefund books the given amount, which has been paid out additionally, as a negative payment with the given message. If completed is true, the refund is marked as completed.
+func (db *DB) BookRefund(refund *Refund, coll *Collection, cents int, completed bool, message string) error {
+
+	if refund.CollID != coll.ID {
+		return errors.New("refund does not belong to collection")
+	}
+
+	var status = RefundPending
+	if completed {
+		status = RefundCompleted
+	}
+
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no effect after commit
+
+	result, err := tx.Stmt(db.updateRefundBooking).Exec(status, refund.BookedCents+cents, refund.ID, refund.BookedCents)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("refund has been booked in the meantime")
+	}
+	if _, err := tx.Stmt(db.createEvent).Exec(coll.ID, coll.State, Today(), -cents, fmt.Sprintf("%s: %s", Bot.Name(), message)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	refund.Status = status
+	refund.BookedCents += cents
+	return nil
+}
+
+func scanRefunds(rows *sql.Rows) ([]*Refund, error) {
+	defer rows.Close()
+	var refunds []*Refund
+	for rows.Next() {
+		var refund = &Refund{}
+		if err := rows.Scan(&refund.ID, &refund.CollID, &refund.Cents, &refund.ClaimLink, &refund.Status, &refund.Created, &refund.BookedCents); err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, refund)
+	}
+	return refunds, rows.Err()
+}
+
+// CreateJob schedules a job. If an active job of the same kind and collection exists, it is run at the earlier time.
+func (db *DB) CreateJob(kind JobKind, collID string, runAt time.Time) error {
+	_, err := db.createJob.Exec(kind, collID, runAt.Unix())
+	return err
+}
+
+func (db *DB) ReadJob(id int) (*Job, error) {
+	return scanJob(db.readJob.QueryRow(id))
+}
+
+// ReadNextJob returns the active job which is due next. If no job is due, it returns ErrNotFound.
+func (db *DB) ReadNextJob(now time.Time) (*Job, error) {
+	job, err := scanJob(db.readNextJob.QueryRow(now.Unix()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return job, err
+}
+
+// ReadFailedJobs returns jobs which have failed at least once.
+func (db *DB) ReadFailedJobs() ([]*Job, error) {
+	rows, err := db.readFailedJobs.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []*Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// FinishJob deletes a successful job. Recurring jobs are rescheduled instead. If the job has been requested again while it was running, it is run again.
+func (db *DB) FinishJob(job *Job, now time.Time) error {
+	if interval := job.Kind.Interval(); interval > 0 {
+		return db.updateJobRow(job, now, now.Add(interval), 0, "", false)
+	}
+	result, err := db.deleteJob.Exec(job.ID, job.Generation)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	return db.requeueJobRow(job, now)
+}
+
+// FailJob records the error and schedules a retry with backoff. Non-recurring jobs are marked as failed after MaxJobAttempts.
+func (db *DB) FailJob(job *Job, now time.Time, jobErr error) error {
+	var attempts = job.Attempts + 1
+	var failed = attempts >= MaxJobAttempts && job.Kind.Interval() == 0
+	var runAt = now.Add(job.Backoff())
+	if interval := job.Kind.Interval(); interval > 0 {
+		runAt = now.Add(min(job.Backoff(), interval))
+	}
+	return db.updateJobRow(job, now, runAt, attempts, jobErr.Error(), failed)
+}
+
+// RetryJob reactivates a job and runs it as soon as possible.
+func (db *DB) RetryJob(job *Job, now time.Time) error {
+	if !job.Failed {
+		return db.updateJobRow(job, now, now, 0, "", false)
+	}
+	// an active job of the same kind and collection might have been created in the meantime
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no effect after commit
+
+	if _, err := tx.Stmt(db.deleteJob).Exec(job.ID, job.Generation); err != nil { // failed jobs are not requested again, so the generation does not change
+		return err
+	}
+	if _, err := tx.Stmt(db.createJob).Exec(job.Kind, job.CollID, now.Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateJobRow updates the job after it has run. If the job has been requested again in the meantime, it is rescheduled to run now instead.
+func (db *DB) updateJobRow(job *Job, now, runAt time.Time, attempts int, lastError string, failed bool) error {
+	result, err := db.updateJob.Exec(runAt.Unix(), attempts, lastError, failed, job.ID, job.Generation)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return db.requeueJobRow(job, now)
+	}
+	job.RunAt = runAt
+	job.Attempts = attempts
+	job.LastError = lastError
+	job.Failed = failed
+	return nil
+}
+
+// requeueJobRow reactivates a job which has been requested again while it was running, so the new request is not lost. It runs again as soon as possible.
+func (db *DB) requeueJobRow(job *Job, now time.Time) error {
+	if _, err := db.requeueJob.Exec(now.Unix(), job.ID); err != nil {
+		return err
+	}
+	job.RunAt = now
+	job.Attempts = 0
+	job.LastError = ""
+	job.Failed = false
+	return nil
+}
+
+func scanJob(row scanner) (*Job, error) {
+	var job = &Job{}
+	var runAt int64
+	if err := row.Scan(&job.ID, &job.Kind, &job.CollID, &runAt, &job.Attempts, &job.LastError, &job.Failed, &job.Generation); err != nil {
+		return nil, err
+	}
+	job.RunAt = time.Unix(runAt, 0)
+	return job, nil
+}
+
+// ReadNotifications returns the send log of a collection.
+func (db *DB) ReadNotifications(collID string) ([]*Notification, error) {
+	rows, err := db.readNotifications.Query(collID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var notifications []*Notification
+	for rows.Next() {
+		var n = &Notification{}
+		if err := rows.Scan(&n.ID, &n.CollID, &n.Kind, &n.State, &n.Status, &n.Attempts, &n.LastError, &n.Created, &n.Sent); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// ReadPendingNotificationColls returns the IDs of collections with pending notifications.
+func (db *DB) ReadPendingNotificationColls() ([]string, error) {
+	rows, err := db.readPendingNotified.Query(NotificationPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// UpdateNotification records the result of a send attempt. If sendErr is nil, the notification gets the given status.
+func (db *DB) UpdateNotification(n *Notification, status NotificationStatus, sendErr error) error {
+	var attempts = n.Attempts + 1
+	var lastError = ""
+	var sent Date
+	if sendErr != nil {
+		status = NotificationPending
+		lastError = sendErr.Error()
+	} else if status == NotificationSent {
+		sent = Today()
+	}
+	if _, err := db.updateNotification.Exec(status, attempts, lastError, sent, n.ID); err != nil {
+		return err
+	}
+	n.Status = status
+	n.Attempts = attempts
+	n.LastError = lastError
+	n.Sent = sent
+	return nil
+}
+
+// ReadStaffEvents returns up to limit staff events with an ID greater than afterID, newest first.
+func (db *DB) ReadStaffEvents(afterID int, limit int) ([]*StaffEvent, error) {
+	rows, err := db.readStaffEvents.Query(afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []*StaffEvent
+	for rows.Next() {
+		var event = &StaffEvent{}
+		if err := rows.Scan(&event.ID, &event.Kind, &event.CollID, &event.Created); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// DeleteStaffEvents deletes staff events which have been created before the given date.
+func (db *DB) DeleteStaffEvents(before Date) error {
+	_, err := db.deleteStaffEvents.Exec(before)
+	return err
+}
+
+// ReadStaffSettings returns the settings of a store user, or the default settings.
+func (db *DB) ReadStaffSettings(username string) (*StaffSettings, error) {
+	var data string
+	err := db.readStaffSettings.QueryRow(username).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DefaultStaffSettings(username), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var settings = &StaffSettings{}
+	if err := json.Unmarshal([]byte(data), settings); err != nil {
+		return nil, err
+	}
+	settings.Username = username
+	return settings, nil
+}
+
+// ReadAllStaffSettings returns the settings of all store users which have saved their settings.
+func (db *DB) ReadAllStaffSettings() ([]*StaffSettings, error) {
+	rows, err := db.readAllStaffSettings.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var all []*StaffSettings
+	for rows.Next() {
+		var data string
+		var settings = &StaffSettings{}
+		if err := rows.Scan(&settings.Username, &data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), settings); err != nil {
+			return nil, err
+		}
+		all = append(all, settings)
+	}
+	return all, rows.Err()
+}
+
+func (db *DB) UpdateStaffSettings(settings *StaffSettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = db.updateStaffSettings.Exec(settings.Username, string(data))
+	return err
+}
+
+// CreateFeedToken creates a new feed token for the collection. An existing token is revoked.
+func (db *DB) CreateFeedToken(collID string) (string, error) {
+	tx, err := db.sqlDB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback() // no effect after commit
+
+	if _, err := tx.Stmt(db.deleteFeedTokens).Exec(collID); err != nil {
+		return "", err
+	}
+	var token = id.New(32, id.AlphanumCaseSensitiveDigits)
+	if _, err := tx.Stmt(db.createFeedToken).Exec(token, collID); err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// ReadFeedToken returns the feed token of the collection, or an empty string if it has none.
+func (db *DB) ReadFeedToken(collID string) (string, error) {
+	var token string
+	err := db.readFeedToken.QueryRow(collID).Scan(&token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return token, err
+}
+
+// ReadFeedColl returns the collection which the feed token belongs to.
+func (db *DB) ReadFeedColl(token string) (*Collection, error) {
+	var collID string
+	if err := db.readFeedCollID.QueryRow(token).Scan(&collID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return db.ReadColl(collID)
+}
+
+func (db *DB) DeleteFeedToken(collID string) error {
+	_, err := db.deleteFeedTokens.Exec(collID)
+	return err
+}
+
+// ReadTOTP returns ErrNotFound if the user has not started TOTP enrolment.
+func (db *DB) ReadTOTP(username string) (*TOTP, error) {
+	var t = &TOTP{Username: username}
+	var recovery string
+	if err := db.readTOTP.QueryRow(username).Scan(&t.Secret, &t.Confirmed, &t.LastStep, &recovery); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(recovery), &t.RecoveryHashes); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (db *DB) UpdateTOTP(t *TOTP) error {
+	recovery, err := json.Marshal(t.RecoveryHashes)
+	if err != nil {
+		return err
+	}
+	_, err = db.updateTOTP.Exec(t.Username, t.Secret, t.Confirmed, t.LastStep, string(recovery))
+	return err
+}
+
+func (db *DB) DeleteTOTP(username string) error {
+	_, err := db.deleteTOTP.Exec(username)
+	return err
+}
+
+// ReadLoginAttempt returns the failed login attempts for the key. If there are none, it returns an empty LoginAttempt.
+func (db *DB) ReadLoginAttempt(key string) (*LoginAttempt, error) {
+	var a = &LoginAttempt{Key: key}
+	var lastFailure, lockedUntil int64
+	err := db.readLoginAttempt.QueryRow(key).Scan(&a.Failures, &lastFailure, &lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.LastFailure = time.Unix(lastFailure, 0)
+	a.LockedUntil = time.Unix(lockedUntil, 0)
+	return a, nil
+}
+
+// ReadLoginAttempts returns all failed login attempts, latest first.
+func (db *DB) ReadLoginAttempts() ([]*LoginAttempt, error) {
+	rows, err := db.readLoginAttempts.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var attempts []*LoginAttempt
+	for rows.Next() {
+		var a = &LoginAttempt{}
+		var lastFailure, lockedUntil int64
+		if err := rows.Scan(&a.Key, &a.Failures, &lastFailure, &lockedUntil); err != nil {
+			return nil, err
+		}
+		a.LastFailure = time.Unix(lastFailure, 0)
+		a.LockedUntil = time.Unix(lockedUntil, 0)
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// LoginFailed records a failed login for each key and locks it if there have been too many.
+func (db *DB) LoginFailed(now time.Time, keys ...string) error {
+	for _, key := range keys {
+		if err := db.loginFailed(now, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) loginFailed(now time.Time, key string) error {
+	var failures int
+	if err := db.failLoginAttempt.QueryRow(key, now.Unix(), int64(resetAfter(key)/time.Second)).Scan(&failures); err != nil {
+		return err
+	}
+	if lockedUntil := loginLockedUntil(key, failures, now); !lockedUntil.IsZero() {
+		if _, err := db.lockLoginAttempt.Exec(lockedUntil.Unix(), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteLoginAttempt resets the counter, after a successful login or if the store unlocks it.
+func (db *DB) DeleteLoginAttempt(key string) error {
+	_, err := db.deleteLoginAttempt.Exec(key)
+	return err
+}
+
+// PruneLoginAttempts deletes counters which would be reset on the next failure anyway. Without it, every guessed ID or username would be kept forever.
+func (db *DB) PruneLoginAttempts(now time.Time) error {
+	_, err := db.pruneLoginAttempts.Exec(now.Add(-loginResetAfter).Unix(), now.Unix())
+	return err
+}
+
+func (db *DB) CreateSession(session *LoginSession) error {
+	_, err := db.createSession.Exec(session.ID, session.Kind, session.Subject, session.Created, session.LastSeen)
+	return err
+}
+
+// ReadSession returns ErrNotFound if the session has been revoked.
+func (db *DB) ReadSession(id string) (*LoginSession, error) {
+	var session = &LoginSession{ID: id}
+	if err := db.readSession.QueryRow(id).Scan(&session.Kind, &session.Subject, &session.Created, &session.LastSeen); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return session, nil
+}
+
+func (db *DB) ReadSessions() ([]*LoginSession, error) {
+	rows, err := db.readSessions.Query()
+	if err != nil {
+		return nil, err
+	}
+	return scanSessions(rows)
+}
+
+func (db *DB) ReadSubjectSessions(kind SessionKind, subject string) ([]*LoginSession, error) {
+	rows, err := db.readSubjectSessions.Query(kind, subject)
+	if err != nil {
+		return nil, err
+	}
+	return scanSessions(rows)
+}
+
+func scanSessions(rows *sql.Rows) ([]*LoginSession, error) {
+	defer rows.Close()
+	var sessions []*LoginSession
+	for rows.Next() {
+		var session = &LoginSession{}
+		if err := rows.Scan(&session.ID, &session.Kind, &session.Subject, &session.Created, &session.LastSeen); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (db *DB) UpdateSessionSeen(session *LoginSession, date Date) error {
+	_, err := db.updateSessionSeen.Exec(date, session.ID)
+	return err
+}
+
+// DeleteSession revokes the session.
+func (db *DB) DeleteSession(id string) error {
+	_, err := db.deleteSession.Exec(id)
+	return err
+}
+
+// DeleteOtherSessions revokes all sessions of the subject except the given one.
+func (db *DB) DeleteOtherSessions(kind SessionKind, subject string, exceptID string) error {
+	_, err := db.deleteOtherSessions.Exec(kind, subject, exceptID)
+	return err
+}
+
+// DeleteIdleSessions removes sessions which have not been seen since the given date. The session manager has expired them already.
+func (db *DB) DeleteIdleSessions(before Date) error {
+	_, err := db.deleteIdleSessions.Exec(before)
+	return err
+}
+
+func (db *DB) CreateAuditEntry(entry *AuditEntry) error {
+	_, err := db.createAuditEntry.Exec(entry.Time.Unix(), entry.Username, entry.Action, entry.Target)
+	return err
+}
+
+// ReadAuditEntries returns up to limit matching entries, newest first.
+func (db *DB) ReadAuditEntries(filter AuditFilter, limit int) ([]*AuditEntry, error) {
+	var to int64 = math.MaxInt64
+	if !filter.To.IsZero() {
+		to = filter.To.Unix()
+	}
+	rows, err := db.readAuditEntries.Query(filter.Username, filter.Username, filter.Action, filter.Target, filter.From.Unix(), to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []*AuditEntry
+	for rows.Next() {
+		var entry = &AuditEntry{}
+		var t int64
+		if err := rows.Scan(&entry.ID, &t, &entry.Username, &entry.Action, &entry.Target); err != nil {
+			return nil, err
+		}
+		entry.Time = time.Unix(t, 0)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// DeleteAuditEntries removes entries which are older than the given time. It is used by the retention only.
+func (db *DB) DeleteAuditEntries(before time.Time) error {
+	_, err := db.deleteAuditEntries.Exec(before.Unix())
+	return err
+}
+
+// ReadAttachment returns the attachment with the given ID if it belongs to the collection.
+func (db *DB) ReadAttachment(collID, id string) (*Attachment, error) {
+	var attachment = &Attachment{ID: id, CollID: collID}
+	err := db.readAttachment.QueryRow(collID, id).Scan(&attachment.EventID, &attachment.Name, &attachment.Type, &attachment.Size)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return attachment, err
+}
+
+// OpenAttachment opens the file of the attachment. The caller must close it.
+func (db *DB) OpenAttachment(attachment *Attachment) (*os.File, error) {
+	return os.Open(filepath.Join(db.attachmentDir, attachment.CollID, attachment.ID))
+}
+
+// DeleteAttachments deletes the attachments of a collection and their files. The events are kept.
+func (db *DB) DeleteAttachments(collID string) error {
+	if _, err := db.deleteAttachments.Exec(collID); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(db.attachmentDir, collID))
 }
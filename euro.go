@@ -0,0 +1,12 @@
+package ordersystem
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// FmtEuro formats an amount of euro cents for humans, like "12,34 Euro".
+func FmtEuro(cents int) string {
+	return strings.Replace(fmt.Sprintf("%.2f Euro", math.Round(float64(cents))/100.0), ".", ",", 1)
+}
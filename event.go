@@ -7,10 +7,12 @@ import (
 )
 
 type Event struct {
-	NewState CollState
-	Date     Date
-	Paid     int    // euro cents, adds to old values, positive amounts were paid by the client, negative amounts were paid by the store
-	Text     string // CommonMark markdown
+	ID          int
+	NewState    CollState
+	Date        Date
+	Paid        int    // euro cents, adds to old values, positive amounts were paid by the client, negative amounts were paid by the store
+	Text        string // CommonMark markdown
+	Attachments []*Attachment
 }
 
 func (e *Event) TextHTML() template.HTML {
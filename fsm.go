@@ -1,5 +1,7 @@
 package ordersystem
 
+import "slices"
+
 type State string
 
 type Transition struct {
@@ -32,7 +34,7 @@ func (fsm *FSM) CanAction(me Actor, from State, action string) bool {
 func (fsm *FSM) From(me Actor) []State {
 	var from = []State{}
 	for _, t := range *fsm {
-		if t.actor == me {
+		if t.actor == me && !slices.Contains(from, t.from) {
 			from = append(from, t.from)
 		}
 	}
@@ -41,7 +43,8 @@ func (fsm *FSM) From(me Actor) []State {
 
 var CollFSM = &FSM{
 	Transition{State(Accepted), Bot, "confirm-payment", State(Active)},
-	Transition{State(Accepted), Bot, "delete", State(Deleted)},
+	Transition{State(Accepted), Bot, "cancel", State(Cancelled)}, // unpaid
+	Transition{State(Accepted), Bot, "remind", State(Accepted)},  // payment reminder
 	Transition{State(Accepted), Client, "cancel", State(Cancelled)},
 	Transition{State(Accepted), Client, "pay", State(Accepted)}, // becomes Paid if payment arrives
 	Transition{State(Accepted), Store, "confirm-payment", State(Active)},
@@ -58,6 +61,11 @@ var CollFSM = &FSM{
 	Transition{State(Submitted), Store, "message", State(Submitted)},
 	Transition{State(Finalized), Store, "message", State(Finalized)}, // "Hi, we just shipped your order."
 	Transition{State(Finalized), Bot, "archive", State(Archived)},
+	Transition{State(Rejected), Bot, "archive", State(Rejected)}, // wipe personal data, keep state
+	Transition{State(Rejected), Bot, "delete", State(Deleted)},
+	Transition{State(Cancelled), Bot, "archive", State(Cancelled)}, // wipe personal data, keep state, because the collection has not been executed
+	Transition{State(Cancelled), Bot, "delete", State(Deleted)},
+	Transition{State(Archived), Bot, "delete", State(Deleted)},
 	Transition{State(NeedsRevise), Client, "cancel", State(Cancelled)},
 	Transition{State(NeedsRevise), Client, "edit", State(NeedsRevise)},
 	Transition{State(NeedsRevise), Client, "submit", State(Submitted)},
@@ -87,6 +95,10 @@ var CollFSM = &FSM{
 	Transition{State(Accepted), Store, "message", State(Accepted)},
 	Transition{State(Accepted), Client, "message", State(Accepted)},
 	Transition{State(Finalized), Store, "activate", State(Active)},
+	Transition{State(Accepted), Store, "refund", State(Accepted)}, // late payments
+	Transition{State(Active), Store, "refund", State(Active)},
+	Transition{State(Cancelled), Store, "refund", State(Cancelled)},
+	Transition{State(Finalized), Store, "refund", State(Finalized)}, // overpaid
 }
 
 var TaskFSM = &FSM{
@@ -7,26 +7,26 @@ toolchain go1.24.3
 require (
 	github.com/alexedwards/scs/sqlite3store v0.0.0-20220528130143-d93ace5be94b
 	github.com/alexedwards/scs/v2 v2.5.0
+	github.com/bitpay/bitpay-go v2.2.2+incompatible
+	github.com/dchest/captcha v1.0.0
 	github.com/dys2p/bitpay v0.1.5
 	github.com/dys2p/btcpay v0.6.0
 	github.com/dys2p/digitalgoods v0.0.0-20221114093158-319682a0d18b
 	github.com/dys2p/eco v0.0.0-20260225190609-070dd2084de5
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	gitlab.com/golang-commonmark/markdown v0.0.0-20211110145824-bf3e522c626a
 	golang.org/x/crypto v0.2.0
 	golang.org/x/text v0.34.0
 )
 
 require (
-	github.com/bitpay/bitpay-go v2.2.2+incompatible // indirect
 	github.com/btcsuite/btcd v0.21.0-beta // indirect
 	github.com/btcsuite/btcutil v1.0.2 // indirect
-	github.com/dchest/captcha v1.0.0 // indirect
-	github.com/dys2p/go-btcpay v0.8.4 // indirect
-	github.com/dys2p/go-paypal v0.2.3 // indirect
+	github.com/emersion/go-sasl v0.0.0-20220912192320-0145f2c60ead // indirect
+	github.com/emersion/go-smtp v0.16.1-0.20230108191019-90d596c5fb00 // indirect
 	github.com/sethvargo/go-diceware v0.3.0 // indirect
-	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e // indirect
 	gitlab.com/golang-commonmark/html v0.0.0-20191124015941-a22733972181 // indirect
 	gitlab.com/golang-commonmark/linkify v0.0.0-20200225224916-64bca66f6ad3 // indirect
 	gitlab.com/golang-commonmark/mdurl v0.0.0-20191124015652-932350d1cb84 // indirect
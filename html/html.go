@@ -7,7 +7,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
-	"strings"
+	texttemplate "text/template"
 
 	"github.com/dys2p/eco/captcha"
 	"github.com/dys2p/eco/ssg"
@@ -22,9 +22,19 @@ var md = markdown.New(markdown.HTML(true), markdown.Linkify(false))
 
 type TemplateData struct {
 	ssg.TemplateData
-	Active           string
-	AuthorizedCollID string
-	Onion            bool
+	Active            string
+	AuthorizedCollID  string   // current collection
+	AuthorizedCollIDs []string // all collections which the session is logged in to
+	Onion             bool
+	CSRFToken         func() string // called only if a form is rendered, so visitors who don't get a form don't get a session either
+}
+
+// CSRF returns a hidden input which carries the CSRF token. Every form with method="post" must contain it.
+func (data TemplateData) CSRF() template.HTML {
+	if data.CSRFToken == nil {
+		return ""
+	}
+	return template.HTML(`<input type="hidden" name="csrf" value="` + template.HTMLEscapeString(data.CSRFToken()) + `">`)
 }
 
 func centsToFloat(cents int) float64 {
@@ -32,7 +42,7 @@ func centsToFloat(cents int) float64 {
 }
 
 func FmtEuro(cents int) string {
-	return strings.Replace(fmt.Sprintf("%.2f Euro", centsToFloat(cents)), ".", ",", 1)
+	return ordersystem.FmtEuro(cents)
 }
 
 func FmtMachine(cents int) string {
@@ -55,25 +65,34 @@ func parse(fn ...string) *template.Template {
 	})
 	t = template.Must(t.Parse(captcha.TemplateString))
 	t = template.Must(t.ParseFS(Files, fn...))
-	t = template.Must(t.ParseGlob(filepath.Join(os.Getenv("CONFIGURATION_DIRECTORY"), "*.html")))
+	if site, _ := filepath.Glob(filepath.Join(os.Getenv("CONFIGURATION_DIRECTORY"), "*.html")); len(site) > 0 { // optional, e.g. in tests
+		t = template.Must(t.ParseFiles(site...))
+	}
 	return t
 }
 
+var Notification = texttemplate.Must(texttemplate.ParseFS(Files, "notification/notification.txt"))
+
+var StaffDigest = texttemplate.Must(texttemplate.ParseFS(Files, "notification/staff-digest.txt"))
+
 var (
-	ClientError         = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/error.html")
-	ClientHello         = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/hello.html")
-	ClientCreate        = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-create.html")
-	ClientCollCancel    = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-cancel.html")
-	ClientCollDelete    = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-delete.html")
-	ClientCollEdit      = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-edit.html")
-	ClientCollLogin     = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-login.html")
-	ClientCollMessage   = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-message.html")
-	ClientCollPayBTCPay = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-pay-btcpay.html")
-	ClientCollSubmit    = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-submit.html")
-	ClientCollView      = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-view.html")
-	ClientSite          = parse("order.proxysto.re/*.html", "common.html", "client.html")
-	ClientStateGet      = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/state-get.html")
-	ClientStatePost     = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/state-post.html")
+	ClientError          = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/error.html")
+	ClientHello          = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/hello.html")
+	ClientCreate         = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-create.html")
+	ClientColls          = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collections.html")
+	ClientCollCancel     = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-cancel.html")
+	ClientCollDelete     = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-delete.html")
+	ClientCollEdit       = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-edit.html")
+	ClientCollLogin      = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-login.html")
+	ClientCollMessage    = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-message.html")
+	ClientCollPassphrase = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-passphrase.html")
+	ClientCollPayBTCPay  = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-pay-btcpay.html")
+	ClientReset          = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/reset.html")
+	ClientCollSubmit     = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-submit.html")
+	ClientCollView       = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/collection-view.html")
+	ClientSite           = parse("order.proxysto.re/*.html", "common.html", "client.html")
+	ClientStateGet       = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/state-get.html")
+	ClientStatePost      = parse("order.proxysto.re/*.html", "common.html", "client.html", "client/state-post.html")
 
 	StoreError                = parse("common.html", "store.html", "store/error.html")
 	StoreIndex                = parse("common.html", "store.html", "store/index.html")
@@ -87,19 +106,32 @@ var (
 	StoreCollEdit             = parse("common.html", "store.html", "store/collection-edit.html")
 	StoreCollMarkSpam         = parse("common.html", "store.html", "store/collection-mark-spam.html")
 	StoreCollMessage          = parse("common.html", "store.html", "store/collection-message.html")
+	StoreBotReport            = parse("common.html", "store.html", "store/bot-report.html")
+	StoreAudit                = parse("common.html", "store.html", "store/audit.html")
+	StoreCollResetCode        = parse("common.html", "store.html", "store/collection-reset-code.html")
+	StoreCollRefund           = parse("common.html", "store.html", "store/collection-refund.html")
 	StoreCollReturn           = parse("common.html", "store.html", "store/collection-return.html")
 	StoreCollReject           = parse("common.html", "store.html", "store/collection-reject.html")
 	StoreCollSubmit           = parse("common.html", "store.html", "store/collection-submit.html")
 	StoreCollView             = parse("common.html", "store.html", "store/collection-view.html")
+	StoreInbox                = parse("common.html", "store.html", "store/inbox.html")
+	StoreLocks                = parse("common.html", "store.html", "store/locks.html")
+	StoreLoginTOTP            = parse("common.html", "store.html", "store/login-totp.html")
+	StoreReviews              = parse("common.html", "store.html", "store/reviews.html")
+	StoreSessions             = parse("common.html", "store.html", "store/sessions.html")
+	StoreSettings             = parse("common.html", "store.html", "store/settings.html")
+	StoreTOTP                 = parse("common.html", "store.html", "store/totp.html")
 	StoreTaskConfirmArrived   = parse("common.html", "store.html", "store/task-confirm-arrived.html")
 	StoreTaskConfirmOrdered   = parse("common.html", "store.html", "store/task-confirm-ordered.html")
 	StoreTaskConfirmPickup    = parse("common.html", "store.html", "store/task-confirm-pickup.html")
 	StoreTaskConfirmReshipped = parse("common.html", "store.html", "store/task-confirm-reshipped.html")
 	StoreTaskMarkFailed       = parse("common.html", "store.html", "store/task-mark-failed.html")
+	StoreWebhooks             = parse("common.html", "store.html", "store/webhooks.html")
 )
 
 // template "task-view"
 type TaskView struct {
+	TemplateData
 	*ordersystem.Task
 	Collection        *ordersystem.Collection
 	StoreBtnArrived   bool
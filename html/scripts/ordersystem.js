@@ -269,6 +269,10 @@ function readData(includeElements = false) {
 		data["reshipping-fee"] = currency(byName("reshipping-fee").value);
 	}
 
+	if(byName("max-total")) {
+		data["max-total"] = currency(byName("max-total").value) || 0; // prevent NaN if value is empty string
+	}
+
 	for(let taskElement of document.querySelectorAll('[data-task]')) {
 		let task = {
 			"id":           inElement(taskElement, "id").value,
@@ -390,5 +394,19 @@ function updateView() {
 				<td><strong>${centsToStr(totalSumWithFee)}</strong></td>
 			</tr>`
 		);
+
+		if(data["max-total"] > 0) {
+			var headroom = data["max-total"] - totalSumWithFee;
+			tbody.insertAdjacentHTML("beforeend",
+				`<tr>
+					<td colspan="3">Budget</td>
+					<td>${centsToStr(data["max-total"])}</td>
+				</tr>
+				<tr class="${headroom < 0 ? "table-danger" : ""}">
+					<td colspan="3">Verbleibend${headroom < 0 ? " (Budget überschritten)" : ""}</td>
+					<td>${centsToStr(headroom)}</td>
+				</tr>`
+			);
+		}
 	}
 }
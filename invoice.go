@@ -0,0 +1,22 @@
+package ordersystem
+
+import "errors"
+
+var ErrInvoiceBooked = errors.New("invoice has been booked already")
+
+type InvoiceStatus string
+
+const (
+	InvoiceBooked InvoiceStatus = "booked" // settled and booked, by webhook or reconciliation
+	InvoiceClosed InvoiceStatus = "closed" // expired or invalid, and not monitored by BTCPay any more
+	InvoiceOpen   InvoiceStatus = "open"
+)
+
+// Invoice is a BTCPay invoice which has been created for a collection.
+// We keep track of them in order to book settled invoices whose webhook has been missed.
+type Invoice struct {
+	ID      string // btcpay.Invoice.ID
+	CollID  string
+	Created Date
+	Status  InvoiceStatus
+}
@@ -0,0 +1,48 @@
+package ordersystem
+
+import "time"
+
+type JobKind string
+
+const (
+	JobColl      JobKind = "coll"      // bot run on a single collection
+	JobNotify    JobKind = "notify"    // send pending notifications of a collection
+	JobReminders JobKind = "reminders" // bot run on accepted collections, recurring
+	JobStaff     JobKind = "staff"     // staff digests, cleanup of old staff events, idle sessions and login counters, recurring
+	JobSweep     JobKind = "sweep"     // payment reconciliation, refunds, bot run on all collections, audit and webhook retention and pending notifications, recurring
+)
+
+// Interval returns the time between two runs of a recurring job, or zero if the job is not recurring.
+func (k JobKind) Interval() time.Duration {
+	switch k {
+	case JobReminders:
+		return 6 * time.Hour
+	case JobStaff:
+		return time.Hour
+	case JobSweep:
+		return 12 * time.Hour
+	default:
+		return 0
+	}
+}
+
+const MaxJobAttempts = 8
+
+// Job is a unit of bot work. It is stored in the database, so it survives restarts.
+// Jobs are deleted when they have succeeded, so we don't keep timestamps longer than necessary.
+type Job struct {
+	ID        int
+	Kind      JobKind
+	CollID    string // JobColl only
+	RunAt     time.Time
+	Attempts  int    // failed attempts
+	LastError string // error of the latest failed attempt
+	Failed    bool   // MaxJobAttempts has been reached, the job won't be retried automatically
+
+	Generation int // incremented when the job is requested again, e.g. while it is running
+}
+
+// Backoff returns the delay after the latest failed attempt: one minute, doubled on each attempt, at most six hours.
+func (job *Job) Backoff() time.Duration {
+	return min(time.Minute<<job.Attempts, 6*time.Hour)
+}
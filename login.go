@@ -0,0 +1,72 @@
+package ordersystem
+
+import (
+	"strings"
+	"time"
+)
+
+// Thresholds of failed login attempts.
+const (
+	LoginCaptchaFailures  = 3  // per ID or username, then a captcha is required
+	LoginLockFailures     = 5  // per ID or username, then the login is locked with exponential backoff
+	SourceCaptchaFailures = 10 // per source address, then a captcha is required for all IDs and usernames
+
+	loginLockMax     = 24 * time.Hour
+	loginResetAfter  = 24 * time.Hour // failures are forgotten after a quiet period
+	sourceResetAfter = time.Hour      // shorter, because all clients behind Tor share one source
+)
+
+func CollLoginKey(collID string) string {
+	return "collection:" + collID
+}
+
+func StoreLoginKey(username string) string {
+	return "store:" + username
+}
+
+func SourceLoginKey(address string) string {
+	return "source:" + address
+}
+
+func IsSourceLoginKey(key string) bool {
+	return strings.HasPrefix(key, "source:")
+}
+
+// resetAfter returns the quiet period after which the failures of the key are forgotten.
+func resetAfter(key string) time.Duration {
+	if IsSourceLoginKey(key) {
+		return sourceResetAfter
+	}
+	return loginResetAfter
+}
+
+// LoginAttempt counts failed logins for a key. Source keys are never locked, because many clients can share a source address, for example if they use Tor.
+type LoginAttempt struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+func (a *LoginAttempt) Locked(now time.Time) bool {
+	return now.Before(a.LockedUntil)
+}
+
+func (a *LoginAttempt) NeedsCaptcha(now time.Time) bool {
+	if now.Sub(a.LastFailure) > resetAfter(a.Key) {
+		return false // the next failure starts over
+	}
+	if IsSourceLoginKey(a.Key) {
+		return a.Failures >= SourceCaptchaFailures
+	}
+	return a.Failures >= LoginCaptchaFailures
+}
+
+// loginLockedUntil returns the end of the lock after the given number of failures, or the zero time if the login is not locked.
+func loginLockedUntil(key string, failures int, now time.Time) time.Time {
+	if IsSourceLoginKey(key) || failures < LoginLockFailures {
+		return time.Time{}
+	}
+	var lock = time.Minute << min(failures-LoginLockFailures, 11) // 1 minute, doubled with each failure
+	return now.Add(min(lock, loginLockMax))
+}
@@ -0,0 +1,62 @@
+package ordersystem
+
+import "slices"
+
+type NotificationKind string
+
+const (
+	NotifyMessage NotificationKind = "message" // the store or the bot has written a message
+	NotifyState   NotificationKind = "state"   // the collection state has changed
+)
+
+type NotificationStatus string
+
+const (
+	NotificationPending NotificationStatus = "pending"
+	NotificationSent    NotificationStatus = "sent"
+	NotificationSkipped NotificationStatus = "skipped" // client has opted out or removed their contact address, or the adapter is not configured
+)
+
+func (s NotificationStatus) Name() string {
+	switch s {
+	case NotificationPending:
+		return "Ausstehend"
+	case NotificationSent:
+		return "Gesendet"
+	case NotificationSkipped:
+		return "Übersprungen"
+	default:
+		return string(s)
+	}
+}
+
+// Notification is an entry of the send log. It contains neither the recipient nor the text, those are taken from the collection when the notification is sent.
+type Notification struct {
+	ID        int
+	CollID    string
+	Kind      NotificationKind
+	State     CollState // collection state at creation
+	Status    NotificationStatus
+	Attempts  int
+	LastError string
+	Created   Date
+	Sent      Date
+}
+
+// NotificationProtocols are the contact protocols for which notification adapters exist.
+var NotificationProtocols = []string{"email", "matrix", "xmpp-otr"}
+
+// CanNotify returns whether the client has given a contact address which we can notify.
+func (coll *Collection) CanNotify() bool {
+	return coll.ClientContact != "" && slices.Contains(NotificationProtocols, coll.ClientContactProtocol)
+}
+
+// CanChangeNotifications returns whether the client can opt out of notifications or in again. Like editing and writing messages, this ends when the collection is finalized or closed.
+func (coll *Collection) CanChangeNotifications() bool {
+	return coll.CanNotify() && (coll.ClientCan("edit") || coll.ClientCan("message"))
+}
+
+// WantsNotifications returns whether we can notify the client and they have not opted out.
+func (coll *Collection) WantsNotifications() bool {
+	return coll.CanNotify() && !coll.NotificationsOptOut
+}
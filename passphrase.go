@@ -0,0 +1,44 @@
+package ordersystem
+
+import (
+	"strings"
+	"time"
+
+	"github.com/dys2p/eco/id"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ResetCodeValidity is the time in which a client can use a reset code issued by the store.
+const ResetCodeValidity = 48 * time.Hour
+
+// NewResetCode creates a one-time code which the client can use to set a new passphrase. It replaces an existing code. The caller must store the collection.
+func (coll *Collection) NewResetCode(now time.Time) (string, error) {
+	var code = id.New(12, id.AlphanumCaseInsensitiveDigits)
+	hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	coll.ResetCodeHash = string(hash)
+	coll.ResetCodeExpires = now.Add(ResetCodeValidity).Unix()
+	return code, nil
+}
+
+func (coll *Collection) CheckResetCode(code string, now time.Time) bool {
+	if coll.ResetCodeHash == "" || now.Unix() > coll.ResetCodeExpires {
+		return false
+	}
+	code = strings.ToUpper(strings.TrimSpace(code))
+	return bcrypt.CompareHashAndPassword([]byte(coll.ResetCodeHash), []byte(code)) == nil
+}
+
+// SetPass sets a new passphrase and removes the reset code. The caller must store it with UpdateCollPass.
+func (coll *Collection) SetPass(pass string) error {
+	hash, err := HashPassword(pass)
+	if err != nil {
+		return err
+	}
+	coll.Pass = string(hash)
+	coll.ResetCodeHash = ""
+	coll.ResetCodeExpires = 0
+	return nil
+}
@@ -0,0 +1,118 @@
+package ordersystem
+
+import (
+	"errors"
+	"slices"
+)
+
+// PriceChange is a store edit which raises the sum of an accepted or active collection above the tolerance. It is stored in the collection data and applies after the client has approved it.
+type PriceChange struct {
+	Date               Date     `json:"date"`
+	Username           string   `json:"username"` // store user who has proposed it
+	DeliveryMethodID   string   `json:"delivery-method-id"`
+	DeliveryGrossPrice int      `json:"delivery-gross-price"`
+	ShippingServiceID  string   `json:"shipping-service-id"`
+	Tasks              TaskList `json:"tasks"` // without state, Merge restores it
+}
+
+// ExceedsMaxTotal returns whether the price change exceeds the budget of the client.
+func (pc *PriceChange) ExceedsMaxTotal(coll *Collection) bool {
+	return coll.MaxTotal > 0 && pc.Sum() > coll.MaxTotal
+}
+
+func (pc *PriceChange) Sum() int {
+	var taskSum = 0
+	for _, task := range pc.Tasks {
+		taskSum += task.TotalSum()
+	}
+	return taskSum + pc.DeliveryGrossPrice
+}
+
+// PriceChangeRow compares the total of a task or of the delivery before and after a price change. Old is zero for added tasks, New is zero for removed tasks.
+type PriceChangeRow struct {
+	Name string
+	Old  int
+	New  int
+}
+
+func (row PriceChangeRow) Changed() bool {
+	return row.Old != row.New
+}
+
+// canChangePrice returns whether the collection state requires client approval of price increases.
+func (coll *Collection) canChangePrice() bool {
+	return coll.State == Accepted || coll.State == Active
+}
+
+// PendingPriceChange returns the price change which waits for client approval, or nil.
+func (coll *Collection) PendingPriceChange() *PriceChange {
+	if !coll.canChangePrice() {
+		return nil
+	}
+	return coll.PriceChange
+}
+
+// DeferPriceChange is called after the store has merged its changes into coll. If the sum of coll exceeds the sum of old by more than tolerance, or exceeds the budget of the client, the tasks and delivery of coll are moved into a pending price change and restored from old. Else a pending price change is dropped, because the store edit replaces it. It returns whether approval is required.
+func (coll *Collection) DeferPriceChange(old *Collection, tolerance int, username string) bool {
+	coll.PriceChange = nil
+	if !coll.canChangePrice() || (coll.Sum() <= old.Sum()+tolerance && !coll.ExceedsMaxTotal()) {
+		return false
+	}
+	coll.PriceChange = &PriceChange{
+		Date:               Today(),
+		Username:           username,
+		DeliveryMethodID:   coll.DeliveryMethodID,
+		DeliveryGrossPrice: coll.DeliveryGrossPrice,
+		ShippingServiceID:  coll.ShippingServiceID,
+		Tasks:              coll.Tasks,
+	}
+	coll.DeliveryMethodID = old.DeliveryMethodID
+	coll.DeliveryGrossPrice = old.DeliveryGrossPrice
+	coll.ShippingServiceID = old.ShippingServiceID
+	coll.Tasks = slices.Clone(old.Tasks)
+	return true
+}
+
+// ApplyPriceChange merges the pending price change into the collection and removes it. If the new sum exceeds the budget, the client has agreed to it, so the budget is raised.
+func (coll *Collection) ApplyPriceChange() error {
+	var pc = coll.PendingPriceChange()
+	if pc == nil {
+		return errors.New("no pending price change")
+	}
+	var input = *coll // copy
+	input.DeliveryMethodID = pc.DeliveryMethodID
+	input.DeliveryGrossPrice = pc.DeliveryGrossPrice
+	input.ShippingServiceID = pc.ShippingServiceID
+	input.Tasks = slices.Clone(pc.Tasks)
+	if err := coll.Merge(Store, &input); err != nil {
+		return err
+	}
+	if coll.ExceedsMaxTotal() {
+		coll.MaxTotal = coll.Sum()
+	}
+	coll.PriceChange = nil
+	return nil
+}
+
+// PriceChangeRows compares the current tasks and delivery with the pending price change.
+func (coll *Collection) PriceChangeRows() []PriceChangeRow {
+	var pc = coll.PendingPriceChange()
+	if pc == nil {
+		return nil
+	}
+	var rows []PriceChangeRow
+	for _, task := range coll.Tasks {
+		var row = PriceChangeRow{Name: task.Merchant, Old: task.TotalSum()}
+		if i := slices.IndexFunc(pc.Tasks, func(t *Task) bool { return t.ID == task.ID }); i >= 0 {
+			row.New = pc.Tasks[i].TotalSum()
+		}
+		rows = append(rows, row)
+	}
+	for _, task := range pc.Tasks {
+		if _, ok := coll.GetTask(task.ID); !ok {
+			rows = append(rows, PriceChangeRow{Name: task.Merchant, New: task.TotalSum()})
+		}
+	}
+	rows = append(rows, PriceChangeRow{Name: "Versand", Old: coll.DeliveryGrossPrice, New: pc.DeliveryGrossPrice})
+	return rows
+}
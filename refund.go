@@ -0,0 +1,39 @@
+package ordersystem
+
+import "errors"
+
+var ErrRefundExceeded = errors.New("refund exceeds the refundable amount")
+
+type RefundStatus string
+
+const (
+	RefundCompleted RefundStatus = "completed"
+	RefundPending   RefundStatus = "pending"
+)
+
+func (s RefundStatus) Name() string {
+	switch s {
+	case RefundCompleted:
+		return "Ausgezahlt"
+	case RefundPending:
+		return "Ausstehend"
+	default:
+		return string(s)
+	}
+}
+
+// Refund is a BTCPay pull payment which the client can claim, possibly in several payouts. The bot books completed payouts as negative payments.
+// The refund is completed when the full amount has been booked or the pull payment has been archived.
+type Refund struct {
+	ID          string // pull payment ID
+	CollID      string
+	Cents       int
+	ClaimLink   string
+	Status      RefundStatus
+	Created     Date
+	BookedCents int // sum of the completed payouts which have been booked
+}
+
+func (refund *Refund) Pending() bool {
+	return refund.Status == RefundPending
+}
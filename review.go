@@ -0,0 +1,85 @@
+package ordersystem
+
+import (
+	"errors"
+	"math"
+)
+
+type ReviewKind string
+
+const (
+	ReviewLate    ReviewKind = "late"    // payment has been received after the invoice expired
+	ReviewPartial ReviewKind = "partial" // payment has been received in time, but the invoice expired before it was paid in full
+)
+
+func (k ReviewKind) Name() string {
+	switch k {
+	case ReviewLate:
+		return "Verspätet"
+	case ReviewPartial:
+		return "Teilzahlung"
+	default:
+		return string(k)
+	}
+}
+
+type ReviewStatus string
+
+const (
+	ReviewBooked        ReviewStatus = "booked"
+	ReviewDismissed     ReviewStatus = "dismissed"
+	ReviewOpen          ReviewStatus = "open"
+	ReviewRefundPending ReviewStatus = "refund-pending"
+)
+
+func (s ReviewStatus) Name() string {
+	switch s {
+	case ReviewBooked:
+		return "Verbucht"
+	case ReviewDismissed:
+		return "Verworfen"
+	case ReviewOpen:
+		return "Offen"
+	case ReviewRefundPending:
+		return "Rückerstattung ausstehend"
+	default:
+		return string(s)
+	}
+}
+
+// Resolved returns whether no further action is required.
+func (s ReviewStatus) Resolved() bool {
+	return s == ReviewBooked || s == ReviewDismissed
+}
+
+// PaymentReview is a crypto payment which has not been booked automatically because it has been received late or partially.
+// The store staff must review it and book a euro amount manually.
+type PaymentReview struct {
+	ID           int
+	CollID       string
+	InvoiceID    string
+	PaymentID    string // bitpay.Payment.ID, unique
+	Kind         ReviewKind
+	CryptoCode   string
+	CryptoAmount float64
+	Rate         float64 // euro per coin at the time of invoice creation
+	Status       ReviewStatus
+	BookedCents  int
+	Created      Date
+	History      []ReviewHistoryEntry // audit trail
+}
+
+type ReviewHistoryEntry struct {
+	Date     Date         `json:"date"`
+	Username string       `json:"username"`
+	Status   ReviewStatus `json:"status"`
+	Cents    int          `json:"cents,omitempty"`
+	Note     string       `json:"note,omitempty"`
+}
+
+// OriginalCents returns the euro value at the original rate.
+func (review *PaymentReview) OriginalCents() int {
+	return int(math.Round(review.CryptoAmount * review.Rate * 100.0))
+}
+
+var ErrReviewResolved = errors.New("payment review has been resolved already")
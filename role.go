@@ -0,0 +1,61 @@
+package ordersystem
+
+import "slices"
+
+// Role of a store user. Permissions are FSM actions of collections and tasks, like "accept" or "confirm-ordered", and the permissions below.
+type Role string
+
+const (
+	RoleAccountant Role = "accountant" // payments, refunds, payment reviews, webhooks, export
+	RoleAdmin      Role = "admin"      // everything
+	RoleClerk      Role = "clerk"      // handles collections and deliveries
+	RolePurchaser  Role = "purchaser"  // orders tasks at merchants
+	RoleViewer     Role = "viewer"     // read-only
+)
+
+// Permissions which are not FSM actions.
+const (
+	PermAudit     = "audit" // read the audit log, admins only
+	PermClaim     = "claim" // claim and release collections
+	PermExport    = "export"
+	PermJobs      = "jobs"       // retry failed jobs
+	PermResetCode = "reset-code" // issue a passphrase reset code to a client
+	PermReviews   = "reviews"    // resolve payment reviews
+	PermSessions  = "sessions"   // list and revoke sessions
+	PermUnlock    = "unlock"     // reset failed login attempts
+	PermView      = "view"       // read-only pages
+	PermWebhooks  = "webhooks"   // replay webhooks
+)
+
+var rolePermissions = map[Role][]string{
+	RoleAccountant: {PermView, PermClaim, PermExport, PermJobs, PermReviews, PermWebhooks, "confirm-payment", "message", "refund"},
+	RoleClerk:      {PermView, PermClaim, PermResetCode, "accept", "activate", "confirm-pickup", "confirm-reshipped", "edit", "mark-spam", "message", "reject", "return", "submit", "confirm-arrived", "mark-failed"},
+	RolePurchaser:  {PermView, PermClaim, "message", "confirm-arrived", "confirm-ordered", "mark-failed"},
+	RoleViewer:     {PermView},
+}
+
+var Roles = []Role{RoleViewer, RoleClerk, RolePurchaser, RoleAccountant, RoleAdmin}
+
+func (r Role) Name() string {
+	switch r {
+	case RoleAccountant:
+		return "Buchhaltung"
+	case RoleAdmin:
+		return "Administration"
+	case RoleClerk:
+		return "Bearbeitung"
+	case RolePurchaser:
+		return "Einkauf"
+	case RoleViewer:
+		return "Nur lesen"
+	default:
+		return string(r)
+	}
+}
+
+func (r Role) Can(permission string) bool {
+	if r == RoleAdmin {
+		return true
+	}
+	return slices.Contains(rolePermissions[r], permission)
+}
@@ -0,0 +1,17 @@
+package ordersystem
+
+type SessionKind string
+
+const (
+	ClientSession SessionKind = "client"
+	StoreSession  SessionKind = "store"
+)
+
+// LoginSession indexes a logged-in session, so it can be listed and revoked. The session data itself is stored by the session manager.
+type LoginSession struct {
+	ID       string // random, stored in the session data
+	Kind     SessionKind
+	Subject  string // collection ID or store username
+	Created  Date
+	LastSeen Date
+}
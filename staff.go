@@ -0,0 +1,68 @@
+package ordersystem
+
+type StaffEventKind string
+
+const (
+	StaffCancelled     StaffEventKind = "cancelled"
+	StaffClientMessage StaffEventKind = "client-message"
+	StaffLatePayment   StaffEventKind = "late-payment" // late or partial, see PaymentReview
+	StaffPaid          StaffEventKind = "paid"
+	StaffSubmitted     StaffEventKind = "submitted"
+)
+
+var StaffEventKinds = []StaffEventKind{StaffSubmitted, StaffPaid, StaffLatePayment, StaffClientMessage, StaffCancelled}
+
+func (k StaffEventKind) Name() string {
+	switch k {
+	case StaffCancelled:
+		return "Abgebrochen"
+	case StaffClientMessage:
+		return "Nachricht vom Client"
+	case StaffLatePayment:
+		return "Zahlung zu prüfen"
+	case StaffPaid:
+		return "Zahlungseingang"
+	case StaffSubmitted:
+		return "Eingereicht"
+	default:
+		return string(k)
+	}
+}
+
+// StaffEvent is an entry of the staff feed. Staff events are not deleted along with the collection, but after some time.
+type StaffEvent struct {
+	ID      int
+	Kind    StaffEventKind
+	CollID  string
+	Created Date
+}
+
+// StaffSettings are the notification settings of a store user.
+type StaffSettings struct {
+	Username       string           `json:"-"`
+	Kinds          []StaffEventKind `json:"kinds"`           // subscribed kinds, shown in the feed and sent in digests
+	DigestProtocol string           `json:"digest-protocol"` // empty if no digests are wanted
+	DigestAddress  string           `json:"digest-address"`
+	LastRead       int              `json:"last-read"`   // StaffEvent.ID
+	LastDigest     int              `json:"last-digest"` // StaffEvent.ID
+}
+
+func DefaultStaffSettings(username string) *StaffSettings {
+	return &StaffSettings{
+		Username: username,
+		Kinds:    StaffEventKinds,
+	}
+}
+
+func (s *StaffSettings) Subscribed(kind StaffEventKind) bool {
+	for _, k := range s.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *StaffSettings) Unread(event *StaffEvent) bool {
+	return event.ID > s.LastRead
+}
@@ -0,0 +1,115 @@
+package ordersystem
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dys2p/eco/id"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30 // seconds
+	totpSkew   = 1  // accepted steps before and after the current one
+
+	recoveryCodes = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP is the second factor of a store user, see RFC 6238. It is used after it has been confirmed with a valid code.
+type TOTP struct {
+	Username       string
+	Secret         string // base32
+	Confirmed      bool
+	LastStep       int64    // prevents replay of a code
+	RecoveryHashes []string // bcrypt, a recovery code can be used once
+}
+
+func NewTOTP(username string) (*TOTP, error) {
+	var secret = make([]byte, 20) // recommended by RFC 4226
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &TOTP{
+		Username: username,
+		Secret:   totpEncoding.EncodeToString(secret),
+	}, nil
+}
+
+// URI returns the provisioning URI for authenticator apps, usually shown as a QR code.
+func (t *TOTP) URI(issuer string) string {
+	var label = url.PathEscape(issuer + ":" + t.Username)
+	var params = url.Values{}
+	params.Set("secret", t.Secret)
+	params.Set("issuer", issuer)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+func totpCode(key []byte, step int64) string {
+	var msg = make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	var mac = hmac.New(sha1.New, key)
+	mac.Write(msg)
+	var sum = mac.Sum(nil)
+	var offset = sum[len(sum)-1] & 0x0f
+	var value = binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// Verify checks the code and updates LastStep if it is valid. The caller must store the TOTP afterwards.
+func (t *TOTP) Verify(code string, now time.Time) bool {
+	code = strings.ReplaceAll(code, " ", "")
+	key, err := totpEncoding.DecodeString(t.Secret)
+	if err != nil {
+		return false
+	}
+	var current = now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= t.LastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			t.LastStep = step
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateRecoveryCodes replaces the recovery codes and returns the new ones in plain text.
+func (t *TOTP) GenerateRecoveryCodes() ([]string, error) {
+	var codes = make([]string, recoveryCodes)
+	var hashes = make([]string, recoveryCodes)
+	for i := range codes {
+		codes[i] = id.New(10, id.AlphanumCaseInsensitiveDigits)
+		hash, err := bcrypt.GenerateFromPassword([]byte(codes[i]), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = string(hash)
+	}
+	t.RecoveryHashes = hashes
+	return codes, nil
+}
+
+// UseRecoveryCode removes the recovery code if it is valid. The caller must store the TOTP afterwards.
+func (t *TOTP) UseRecoveryCode(code string) bool {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	for i, hash := range t.RecoveryHashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			t.RecoveryHashes = append(t.RecoveryHashes[:i], t.RecoveryHashes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
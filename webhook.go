@@ -0,0 +1,46 @@
+package ordersystem
+
+import "time"
+
+type WebhookStatus string
+
+const (
+	WebhookFailed    WebhookStatus = "failed"
+	WebhookPending   WebhookStatus = "pending"
+	WebhookProcessed WebhookStatus = "processed"
+)
+
+func (s WebhookStatus) Name() string {
+	switch s {
+	case WebhookFailed:
+		return "Fehlgeschlagen"
+	case WebhookPending:
+		return "Ausstehend"
+	case WebhookProcessed:
+		return "Verarbeitet"
+	default:
+		return string(s)
+	}
+}
+
+// Webhook is an incoming webhook delivery, stored after its signature has been verified.
+type Webhook struct {
+	ID         int
+	DeliveryID string // btcpay.InvoiceEvent.OriginalDeliveryID if it is a redelivery, else DeliveryID
+	InvoiceID  string
+	Type       string
+	Payload    string // raw request body
+	Status     WebhookStatus
+	Error      string // latest processing error
+	Attempts   int
+	Received   time.Time
+	Processed  time.Time // latest processing attempt, zero if none
+}
+
+// RejectedWebhook is an incoming delivery whose signature or store ID is wrong.
+type RejectedWebhook struct {
+	ID       int
+	Received time.Time
+	Error    string
+	Payload  string // raw request body, truncated
+}